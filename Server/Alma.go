@@ -3,8 +3,11 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
 
@@ -13,21 +16,46 @@ import (
 //
 
 type AlmaServer struct {
+	api string // Base URL of the API; empty = North American server
 	key string // API access key
 }
 
+// BarcodeItem.Source for items fetched from Alma
+const almaSource = "alma"
+
+func init() {
+	extractors[almaSource] = &AlmaServer {}
+}
+
 // params = just the API access key
 func (s *AlmaServer) Startup(params string) {
 	s.key = params
+	s.api = strings.TrimSuffix(s.api,"/")
+	if s.api == "" { s.api = "https://api-na.hosted.exlibrisgroup.com/almaws/v1" }
 }
 
 // Dummy function (included to satisfy BarcodeServerInterface)
 func (s *AlmaServer) Shutdown() {}
 
+// Alma error code for a barcode matching no item
+const almaNoItem = "401689"
+
 // Returns a BarcodeItem using the Alma database
 func (s *AlmaServer) Lookup(barcode string) (*BarcodeItem) {
-	API := "https://api-na.hosted.exlibrisgroup.com/almaws/v1"
-	URL := fmt.Sprintf("%s/items?item_barcode=%s",API,barcode)
+	result, err := s.LookupAlma(barcode)
+	if err != nil { log.Println("Unable to fetch Alma data for barcode "+barcode+": ",err) }
+	return result
+}
+
+// Returns true, as this is an Alma server
+func (s *AlmaServer) HasAlma() (bool) {
+	return true
+}
+
+// Returns a BarcodeItem using the Alma database, or errNotFound only if
+// Alma reports that no item has the barcode
+func (s *AlmaServer) LookupAlma(barcode string) (*BarcodeItem, error) {
+	URL := fmt.Sprintf("%s/items?item_barcode=%s",s.api,url.QueryEscape(barcode))
 
 	client := http.Client{}
 	req, err := http.NewRequest("GET",URL,nil)
@@ -37,24 +65,44 @@ func (s *AlmaServer) Lookup(barcode string) (*BarcodeItem) {
 	req.Header.Set("Authorization", fmt.Sprintf("apikey %s",s.key))
 
 	resp, err := client.Do(req)
-	if err != nil {
-		log.Println("Unable to fetch Alma data for barcode "+barcode)
-		return nil
-	}
+	if err != nil { return nil, err }
 
 	defer resp.Body.Close()
 
+	body, err := io.ReadAll(resp.Body)
+	if err != nil { return nil, err }
+
 	if resp.StatusCode != 200 {
-		log.Println("Non-200 return code from Alma server!")
-		log.Println("Status: ",resp.Status)
-		log.Println("StatusCode: ",resp.StatusCode)
-		log.Println("Header: ",resp.Header)
-		log.Println("Request: ",resp.Request)
-		return nil
+		var e struct {
+			ErrorList struct {
+				Error []struct {
+					ErrorCode string `json:"errorCode"`
+				} `json:"error"`
+			} `json:"errorList"`
+		}
+
+		if resp.StatusCode == 400 && json.Unmarshal(body,&e) == nil {
+			for _, x := range e.ErrorList.Error {
+				if x.ErrorCode == almaNoItem { return nil, errNotFound }
+			}
+		}
+		return nil, fmt.Errorf("status %s from Alma server", resp.Status)
 	}
 
+	result := s.Extract(barcode,body)
+	if result == nil { return nil, fmt.Errorf("unexpected Alma response") }
+	result.Raw = body
+
+	return result, nil
+}
+
+// Returns a BarcodeItem built from a raw Alma items response
+func (s *AlmaServer) Extract(barcode string, raw []byte) (*BarcodeItem) {
 	var m map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&m)
+	if err := json.Unmarshal(raw,&m); err != nil {
+		log.Println("Unable to decode Alma json data!")
+		return nil
+	}
 
 	bib_data, ok := m["bib_data"]
 	if !ok {
@@ -64,7 +112,7 @@ func (s *AlmaServer) Lookup(barcode string) (*BarcodeItem) {
 
 	switch x := bib_data.(type) {
 		case map[string]interface{}:
-			result := BarcodeItem { Barcode: barcode }
+			result := BarcodeItem { Barcode: barcode, Source: almaSource }
 
 			y, ok := x["isbn"]
 			if ok { result.ISBN, _ = y.(string) }
@@ -87,3 +135,40 @@ func (s *AlmaServer) Lookup(barcode string) (*BarcodeItem) {
 func (s *AlmaServer) Store(info *BarcodeItem) {
 	log.Println("Store called on read-only Alma server!")
 }
+
+// Returns the number of items Alma holds for the bib record of a cached item,
+// given the item's raw payload.
+func (s *AlmaServer) CountCopies(barcode string, raw []byte) (int, bool) {
+	var m struct {
+		BibData struct {
+			MMSID string `json:"mms_id"`
+		} `json:"bib_data"`
+	}
+
+	if err := json.Unmarshal(raw,&m); err != nil || m.BibData.MMSID == "" {
+		log.Println("No Alma mms_id stored for barcode "+barcode)
+		return 0, false
+	}
+
+	URL := fmt.Sprintf("%s/bibs/%s/holdings/ALL/items?limit=1",s.api,url.PathEscape(m.BibData.MMSID))
+
+	req, err := http.NewRequest("GET",URL,nil)
+	boom(err,"Unable to create HTTP request")
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("apikey %s",s.key))
+
+	body := fetchBody(req,"Alma")
+	if body == nil { return 0, false }
+
+	var items struct {
+		Total *int `json:"total_record_count"`
+	}
+
+	if err := json.Unmarshal(body,&items); err != nil || items.Total == nil {
+		log.Println("Alma items list has no 'total_record_count' value!")
+		return 0, false
+	}
+
+	return *items.Total, true
+}
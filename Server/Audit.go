@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+// Drift audit: how far the cache has drifted from upstream. A random sample
+// of cached items is looked up again and compared field by field; the report
+// gives the items that changed or were deleted upstream, and the drift rate.
+// Optionally the cache is corrected. Items are looked up in the tenant's Alma
+// upstream alone (as routed), never in a parent, peers or fallbacks; only an
+// item Alma reports it has no record of counts as deleted, and lookups that
+// fail otherwise are skipped and reported.
+//
+
+type AuditMismatch struct {
+	Barcode string `json:"barcode"`
+	Deleted bool `json:"deleted,omitempty"` // No longer found upstream
+	Differences []string `json:"differences,omitempty"`
+	Fixed bool `json:"fixed,omitempty"`
+}
+
+type AuditSkip struct {
+	Barcode string `json:"barcode"`
+	Reason string `json:"reason"`
+}
+
+type AuditReport struct {
+	Started time.Time `json:"started"`
+	Sampled int `json:"sampled"`
+	Checked int `json:"checked"` // Sampled items looked up upstream
+	Matched int `json:"matched"`
+	Changed int `json:"changed"`
+	Deleted int `json:"deleted"`
+	Skipped []AuditSkip `json:"skipped"` // Sampled items whose lookup failed
+	DriftRate float64 `json:"drift_rate"` // (changed + deleted) / checked
+	Fields map[string]int `json:"field_mismatches"` // Changed items, by field
+	Mismatches []AuditMismatch `json:"mismatches"`
+}
+
+// Writes the report in human-readable form
+func (r *AuditReport) write(w io.Writer) {
+	fmt.Fprintf(w, "Audit of %d cached items (%d checked upstream):\n", r.Sampled, r.Checked)
+	fmt.Fprintf(w, "  %d matched, %d changed, %d deleted upstream; drift rate %.1f%%\n", r.Matched, r.Changed, r.Deleted, 100*r.DriftRate)
+
+	fields := []string {}
+	for field := range r.Fields { fields = append(fields,field) }
+	sort.Strings(fields)
+	for _, field := range fields {
+		fmt.Fprintf(w, "  %s differs in %d items\n", field, r.Fields[field])
+	}
+
+	if len(r.Skipped) > 0 { fmt.Fprintf(w, "  %d skipped, as their lookup failed\n", len(r.Skipped)) }
+
+	for _, m := range r.Mismatches {
+		fixed := ""
+		if m.Fixed { fixed = " [fixed]" }
+
+		if m.Deleted {
+			fmt.Fprintf(w, "- %s: deleted upstream%s\n", m.Barcode, fixed)
+		} else {
+			fmt.Fprintf(w, "- %s: %s%s\n", m.Barcode, strings.Join(m.Differences,"; "), fixed)
+		}
+	}
+
+	for _, skip := range r.Skipped {
+		fmt.Fprintf(w, "- %s: skipped (%s)\n", skip.Barcode, skip.Reason)
+	}
+}
+
+func init() {
+	commands["audit"] = auditCommand
+}
+
+func auditCommand(args []string, localServer BarcodeServerInterface, remoteServer BarcodeServerInterface) error {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	n := flags.Int("n", 100, "Number of cached items to sample.")
+	fix := flags.Bool("fix", false, "Update changed items, and remove items deleted upstream.")
+	jsonFile := flags.String("json", "", "Also write the report as JSON to this file (- = stdout).")
+	if err := flags.Parse(args); err != nil { return err }
+
+	if *n < 1 { return fmt.Errorf("-n must be at least 1") }
+
+	auditor, ok := localServer.(AuditInterface)
+	if !ok { return fmt.Errorf("local server does not support auditing") }
+
+	refresher, canRefresh := localServer.(RefreshInterface)
+	if *fix && !canRefresh { return fmt.Errorf("local server cannot update items") }
+
+	alma, ok := remoteServer.(AlmaLookupInterface)
+	if !ok || !alma.HasAlma() { return fmt.Errorf("auditing needs an Alma upstream") }
+
+	report := AuditReport {
+		Started: time.Now().UTC(),
+		Fields: map[string]int {},
+		Mismatches: []AuditMismatch {},
+		Skipped: []AuditSkip {},
+	}
+
+	items := auditor.Sample(*n)
+	report.Sampled = len(items)
+
+	for _, old := range items {
+		fresh, err := alma.LookupAlma(old.Barcode)
+
+		if err == errQuotaExhausted {
+			log.Println("Audit: upstream quota exhausted; stopping early")
+			break
+		}
+		if err != nil && err != errNotFound {
+			log.Println("Audit: skipping barcode \""+old.Barcode+"\": ",err)
+			report.Skipped = append(report.Skipped, AuditSkip { Barcode: old.Barcode, Reason: err.Error() })
+			continue
+		}
+
+		report.Checked++
+
+		if err == errNotFound {
+			report.Deleted++
+			m := AuditMismatch { Barcode: old.Barcode, Deleted: true }
+			if *fix {
+				auditor.Delete(old.Barcode)
+				m.Fixed = true
+			}
+			report.Mismatches = append(report.Mismatches,m)
+			continue
+		}
+
+		normalizeISBNs(fresh)
+		diffs := diffItems(old,fresh)
+		if len(diffs) == 0 {
+			report.Matched++
+			continue
+		}
+
+		report.Changed++
+		for _, d := range diffs { report.Fields[strings.SplitN(d,":",2)[0]]++ }
+
+		m := AuditMismatch { Barcode: old.Barcode, Differences: diffs }
+		if *fix {
+			now := time.Now().UTC()
+			fresh.Symbology, fresh.Fetched = barcodeSymbology(old.Barcode), &now
+			refresher.Refresh(fresh)
+			m.Fixed = true
+		}
+		report.Mismatches = append(report.Mismatches,m)
+	}
+
+	if report.Checked > 0 {
+		report.DriftRate = float64(report.Changed+report.Deleted) / float64(report.Checked)
+	}
+
+	report.write(os.Stdout)
+
+	if *jsonFile != "" {
+		out := os.Stdout
+		if *jsonFile != "-" {
+			var err error
+			if out, err = os.Create(*jsonFile); err != nil { return err }
+			defer out.Close()
+		}
+
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(&report); err != nil { return err }
+	}
+
+	return nil
+}
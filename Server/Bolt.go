@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+//
+// Embedded key-value storage, for small deployments without a SQL database:
+// a single bbolt file, with a bucket of items (see KV.go) keyed on barcode, a bucket
+// indexing them by canonical ISBN-13 and a bucket of cached HTTP responses.
+// Searching and listing scan the items, which is fine for a branch-sized
+// cache. The file is locked while open, so commands need the server stopped.
+//
+
+type BoltServer struct {
+	table string // bucket name (empty = "barcodes")
+	conflict string // policy for items already stored (empty = newest)
+	path string
+	db *bolt.DB
+}
+
+// Stored form of a HTTP response; the body is compressed
+type boltResponse struct {
+	URL string `json:"u"`
+	Status int `json:"s"`
+	ContentType string `json:"c"`
+	Body []byte `json:"b"`
+	Fetched int64 `json:"f"`
+}
+
+// Database files open in this process, shared by the tenants' servers, as a
+// bbolt file cannot be opened twice
+var boltFiles = struct {
+	byPath map[string]*boltFile
+	mutex sync.Mutex
+} { byPath: map[string]*boltFile {} }
+
+type boltFile struct {
+	db *bolt.DB
+	users int
+}
+
+// Another process holding the file's lock is taken for the database being
+// unreachable, so the server waits for it
+func init() {
+	unreachableChecks = append(unreachableChecks, func(err error) (bool) {
+		return errors.Is(err,bolt.ErrTimeout) || errors.Is(err,bolt.ErrDatabaseNotOpen)
+	})
+}
+
+func (s *BoltServer) items(tx *bolt.Tx) (*bolt.Bucket) { return tx.Bucket([]byte(s.table)) }
+func (s *BoltServer) isbns(tx *bolt.Tx) (*bolt.Bucket) { return tx.Bucket([]byte(s.table+"_isbns")) }
+func (s *BoltServer) responses(tx *bolt.Tx) (*bolt.Bucket) { return tx.Bucket([]byte(s.table+"_responses")) }
+
+// params = bbolt file path
+func (s *BoltServer) Startup(params string) {
+	s.Shutdown()
+
+	if s.table == "" { s.table = "barcodes" }
+	s.path = params
+
+	boltFiles.mutex.Lock()
+	file := boltFiles.byPath[s.path]
+	if file == nil {
+		// Fail rather than wait forever if another process has the file open
+		db, err := bolt.Open(s.path, 0644, &bolt.Options { Timeout: 5*time.Second })
+		if err != nil {
+			boltFiles.mutex.Unlock()
+			dbBoom(err, "Unable to open bbolt database "+s.path)
+		}
+		file = &boltFile { db: db }
+		boltFiles.byPath[s.path] = file
+	}
+	file.users++
+	s.db = file.db
+	boltFiles.mutex.Unlock()
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string {s.table, s.table+"_isbns", s.table+"_responses"} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil { return err }
+		}
+		return nil
+	})
+	dbBoom(err, "Unable to set up database ")
+}
+
+// Closes the database file, once no other server uses it
+func (s *BoltServer) Shutdown() {
+	if s.db == nil { return }
+
+	boltFiles.mutex.Lock()
+	defer boltFiles.mutex.Unlock()
+
+	if file := boltFiles.byPath[s.path]; file != nil {
+		file.users--
+		if file.users == 0 {
+			file.db.Close()
+			delete(boltFiles.byPath,s.path)
+		}
+	}
+	s.db = nil
+}
+
+// Returns the stored item for a barcode, or nil if absent
+func (s *BoltServer) get(tx *bolt.Tx, barcode string) (*kvItem, error) {
+	data := s.items(tx).Get([]byte(barcode))
+	if data == nil { return nil, nil }
+
+	b := kvItem {}
+	if err := json.Unmarshal(data,&b); err != nil { return nil, err }
+	return &b, nil
+}
+
+func (s *BoltServer) put(tx *bolt.Tx, b *kvItem) (error) {
+	data, err := json.Marshal(b)
+	if err != nil { return err }
+	return s.items(tx).Put([]byte(b.Barcode),data)
+}
+
+// Calls fn on every stored item, in barcode order, until it returns false
+func (s *BoltServer) each(tx *bolt.Tx, fn func(b *kvItem) bool) (error) {
+	c := s.items(tx).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		b := kvItem {}
+		if err := json.Unmarshal(v,&b); err != nil { return err }
+		if !fn(&b) { return nil }
+	}
+	return nil
+}
+
+// Returns every stored item, in barcode order
+func (s *BoltServer) all() ([]*kvItem, error) {
+	all := []*kvItem {}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return s.each(tx, func(b *kvItem) bool {
+			all = append(all,b)
+			return true
+		})
+	})
+	return all, err
+}
+
+// Replaces the ISBN index entries for a barcode
+func (s *BoltServer) writeISBNs(tx *bolt.Tx, barcode string, old []string, isbns []string) (error) {
+	index := s.isbns(tx)
+	for _, isbn := range old {
+		if err := index.Delete([]byte(isbn+"/"+barcode)); err != nil { return err }
+	}
+	for _, isbn := range isbns {
+		if err := index.Put([]byte(isbn+"/"+barcode),[]byte {}); err != nil { return err }
+	}
+	return nil
+}
+
+// Stores an item, or resolves its conflict with an existing one according to
+// policy (as for SQL); returns true if it was written. Access counts are kept.
+func (s *BoltServer) writeItem(tx *bolt.Tx, item *BarcodeItem, policy string) (bool, error) {
+	b, err := newKVItem(item)
+	if err != nil { return false, err }
+
+	old, err := s.get(tx,item.Barcode)
+	if err != nil { return false, err }
+
+	var oldISBNs []string
+	if old != nil {
+		switch policy {
+			case "skip": return false, nil
+			case "newest": if b.Fetched <= old.Fetched { return false, nil }
+			case "overwrite":
+			default: return false, fmt.Errorf("unknown conflict policy '%s' (use skip, overwrite or newest)", policy)
+		}
+		b.Hits, b.Accessed, oldISBNs = old.Hits, old.Accessed, old.ISBNs
+	}
+
+	if err := s.put(tx,b); err != nil { return false, err }
+	return true, s.writeISBNs(tx,b.Barcode,oldISBNs,b.ISBNs)
+}
+
+// Returns a BarcodeItem from the database
+func (s *BoltServer) Lookup(barcode string) (*BarcodeItem) {
+	var result *BarcodeItem
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := s.get(tx,barcode)
+		if b != nil { result = b.item() }
+		return err
+	})
+	dbBoom(err, "Unable to lookup item")
+	return result
+}
+
+// Stores a BarcodeItem in the database, resolving conflicts by the policy
+func (s *BoltServer) Store(item *BarcodeItem) {
+	policy := s.conflict
+	if policy == "" { policy = "newest" }
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		_, err := s.writeItem(tx,item,policy)
+		return err
+	})
+	dbBoom(err, "Unable to store item")
+}
+
+// Overwrites the normalized fields of a BarcodeItem in the database
+func (s *BoltServer) Update(item *BarcodeItem) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := s.get(tx,item.Barcode)
+		if b == nil || err != nil { return err }
+
+		oldISBNs := b.ISBNs
+		b.ISBN, b.Author, b.Title, b.Source = item.ISBN, item.Author, item.Title, item.Source
+		b.ISBNs, b.Search = parseISBNs(item.ISBN), searchText(item)
+
+		if err := s.put(tx,b); err != nil { return err }
+		return s.writeISBNs(tx,b.Barcode,oldISBNs,b.ISBNs)
+	})
+	dbBoom(err, "Unable to update item")
+}
+
+// Returns the raw upstream payload and its source for a barcode
+func (s *BoltServer) LookupRaw(barcode string) ([]byte, string) {
+	var raw []byte
+	var source string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := s.get(tx,barcode)
+		if b == nil || err != nil { return err }
+
+		source = b.Source
+		raw, err = decompress(b.Raw)
+		return err
+	})
+	dbBoom(err, "Unable to lookup raw payload")
+	return raw, source
+}
+
+// Calls fn on every stored raw upstream payload. Items are read a page at a
+// time, outside any transaction, so fn may safely write to the database.
+func (s *BoltServer) EachRaw(fn func(barcode, source string, raw []byte)) {
+	const pageSize = 100
+	after := []byte(nil)
+
+	for {
+		page, scanned := []*kvItem {}, 0
+		err := s.db.View(func(tx *bolt.Tx) error {
+			c := s.items(tx).Cursor()
+			k, v := c.First()
+			if after != nil {
+				if k, v = c.Seek(after); k != nil && string(k) == string(after) { k, v = c.Next() }
+			}
+
+			for ; k != nil && scanned < pageSize; k, v = c.Next() {
+				scanned++
+				b := kvItem {}
+				if err := json.Unmarshal(v,&b); err != nil { return err }
+				after = append([]byte(nil),k...)
+				if b.Raw != nil { page = append(page,&b) }
+			}
+			return nil
+		})
+		dbBoom(err, "Unable to iterate raw payloads")
+
+		for _, b := range page {
+			raw, err := decompress(b.Raw)
+			dbBoom(err, "Unable to iterate raw payloads")
+			fn(b.Barcode,b.Source,raw)
+		}
+
+		if scanned < pageSize { return }
+	}
+}
+
+// Returns every BarcodeItem in the database with the given ISBN-13
+func (s *BoltServer) LookupISBN(isbn string) ([]*BarcodeItem) {
+	items := []*BarcodeItem {}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(isbn+"/")
+		c := s.isbns(tx).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && strings.HasPrefix(string(k),string(prefix)); k, _ = c.Next() {
+			b, err := s.get(tx,strings.TrimPrefix(string(k),string(prefix)))
+			if err != nil { return err }
+			if b != nil { items = append(items,b.item()) }
+		}
+		return nil
+	})
+	dbBoom(err, "Unable to lookup ISBN")
+	return items
+}
+
+// Returns the BarcodeItems in the database matching the search terms
+func (s *BoltServer) Search(terms []string, limit, offset int) ([]*BarcodeItem) {
+	all, err := s.all()
+	dbBoom(err, "Unable to search items")
+	return kvSearch(all,terms,limit,offset)
+}
+
+// Returns a page of BarcodeItems from the database
+func (s *BoltServer) List(q ListQuery) ([]*BarcodeItem) {
+	all, err := s.all()
+	dbBoom(err, "Unable to list items")
+	return kvList(all,q)
+}
+
+// Stores a batch of BarcodeItems in the database, resolving conflicts by policy
+func (s *BoltServer) Import(items []*BarcodeItem, policy string) (ImportResult, error) {
+	result := ImportResult {}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		result = ImportResult {}
+
+		for _, item := range items {
+			old, err := s.get(tx,item.Barcode)
+			if err != nil { return err }
+
+			// Without a fetch time, an item cannot be newer
+			if old != nil && policy == "newest" && item.Fetched == nil {
+				result.Skipped++
+				continue
+			}
+
+			written, err := s.writeItem(tx,item,policy)
+			switch {
+				case err != nil: return err
+				case !written: result.Skipped++
+				case old != nil: result.Updated++
+				default: result.Inserted++
+			}
+		}
+		return nil
+	})
+	if err != nil { return ImportResult {}, err }
+	return result, nil
+}
+
+// Counts a request served with the item
+func (s *BoltServer) RecordAccess(barcode string) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := s.get(tx,barcode)
+		if b == nil || err != nil { return err }
+
+		b.Hits++
+		b.Accessed = time.Now().Unix()
+		return s.put(tx,b)
+	})
+	dbBoom(err, "Unable to record access")
+}
+
+// Returns items from the database fetched before the given time
+func (s *BoltServer) Stale(order string, before time.Time, limit int) ([]*BarcodeItem) {
+	all, err := s.all()
+	dbBoom(err, "Unable to find stale items")
+	return kvStale(all,order,before,limit)
+}
+
+// Replaces an item in the database with a fresh copy
+func (s *BoltServer) Refresh(item *BarcodeItem) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		_, err := s.writeItem(tx,item,"overwrite")
+		return err
+	})
+	dbBoom(err, "Unable to refresh item")
+}
+
+// Sets the time an item in the database was last checked upstream
+func (s *BoltServer) MarkFetched(barcode string, when time.Time) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := s.get(tx,barcode)
+		if b == nil || err != nil { return err }
+
+		b.Fetched = when.Unix()
+		return s.put(tx,b)
+	})
+	dbBoom(err, "Unable to mark item fetched")
+}
+
+// Returns up to n items from the database, chosen at random
+func (s *BoltServer) Sample(n int) ([]*BarcodeItem) {
+	sample := []*kvItem {}
+	seen := 0
+
+	// Reservoir sampling, in one pass
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return s.each(tx, func(b *kvItem) bool {
+			seen++
+			if len(sample) < n {
+				sample = append(sample,b)
+			} else if i := rand.Intn(seen); i < n {
+				sample[i] = b
+			}
+			return true
+		})
+	})
+	dbBoom(err, "Unable to sample items")
+
+	rand.Shuffle(len(sample), func(i, j int) { sample[i], sample[j] = sample[j], sample[i] })
+
+	items := []*BarcodeItem {}
+	for _, b := range sample { items = append(items,b.item()) }
+	return items
+}
+
+// Removes an item from the database
+func (s *BoltServer) Delete(barcode string) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := s.get(tx,barcode)
+		if b == nil || err != nil { return err }
+
+		if err := s.writeISBNs(tx,barcode,b.ISBNs,nil); err != nil { return err }
+		return s.items(tx).Delete([]byte(barcode))
+	})
+	dbBoom(err, "Unable to delete item")
+}
+
+// Returns a cached HTTP response from the database
+func (s *BoltServer) LookupResponse(key string) (*CachedResponse) {
+	var result *CachedResponse
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := s.responses(tx).Get([]byte(key))
+		if data == nil { return nil }
+
+		r := boltResponse {}
+		if err := json.Unmarshal(data,&r); err != nil { return err }
+
+		body, err := decompress(r.Body)
+		if err != nil { return err }
+
+		result = &CachedResponse {
+			Key: key, URL: r.URL, Status: r.Status, ContentType: r.ContentType,
+			Body: body, Fetched: time.Unix(r.Fetched,0),
+		}
+		return nil
+	})
+	dbBoom(err, "Unable to lookup response")
+	return result
+}
+
+// Stores a HTTP response in the database
+func (s *BoltServer) StoreResponse(resp *CachedResponse) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		body, err := compress(resp.Body)
+		if err != nil { return err }
+
+		data, err := json.Marshal(&boltResponse {
+			URL: resp.URL, Status: resp.Status, ContentType: resp.ContentType,
+			Body: body, Fetched: resp.Fetched.Unix(),
+		})
+		if err != nil { return err }
+
+		return s.responses(tx).Put([]byte(resp.Key),data)
+	})
+	dbBoom(err, "Unable to store response")
+}
+
+// Reports the numbers of items, indexed ISBNs and cached responses
+func (s *BoltServer) Stats() (map[string]interface{}) {
+	stats := map[string]interface{} {}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		stats["items"] = s.items(tx).Stats().KeyN
+		stats["isbns"] = s.isbns(tx).Stats().KeyN
+		stats["responses"] = s.responses(tx).Stats().KeyN
+		return nil
+	})
+	if err != nil { log.Println("Unable to count items: ",err) }
+	return stats
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+)
+
+//
+// BarcodeServerInterface implementation that tries a list of upstream
+// servers in order, returning the first result found. The servers should
+// already have been started.
+//
+
+type ChainServer struct {
+	servers []BarcodeServerInterface
+}
+
+// Dummy function (included to satisfy BarcodeServerInterface)
+func (s *ChainServer) Startup(_ string) {}
+
+// Shuts down every server in the chain
+func (s *ChainServer) Shutdown() {
+	for _, server := range s.servers { server.Shutdown() }
+}
+
+// Returns the first BarcodeItem found by the servers in the chain
+func (s *ChainServer) Lookup(barcode string) (*BarcodeItem) { return s.LookupVia(barcode,nil) }
+
+// As Lookup, for a request forwarded by the given servers
+func (s *ChainServer) LookupVia(barcode string, via []string) (*BarcodeItem) {
+	for _, server := range s.servers {
+		if result := lookupVia(server,barcode,via); result != nil { return result }
+	}
+	return nil
+}
+
+// Dummy function (included to satisfy BarcodeServerInterface)
+func (s *ChainServer) Store(info *BarcodeItem) {
+	log.Println("Store called on read-only chain server!")
+}
+
+// Merges the statistics of any servers in the chain that provide them
+func (s *ChainServer) Stats() (map[string]interface{}) {
+	stats := map[string]interface{} {}
+	for _, server := range s.servers {
+		if x, ok := server.(StatsInterface); ok {
+			for k, v := range x.Stats() { stats[k] = v }
+		}
+	}
+	return stats
+}
+
+// Returns the copy count from the first server in the chain able to give one
+func (s *ChainServer) CountCopies(barcode string, raw []byte) (int, bool) {
+	for _, server := range s.servers {
+		if x, ok := server.(CopyCounterInterface); ok {
+			if n, ok := x.CountCopies(barcode,raw); ok { return n, true }
+		}
+	}
+	return 0, false
+}
+
+// Returns true if any server in the chain looks barcodes up in Alma
+func (s *ChainServer) HasAlma() (bool) {
+	for _, server := range s.servers {
+		if x, ok := server.(AlmaLookupInterface); ok && x.HasAlma() { return true }
+	}
+	return false
+}
+
+// Returns a BarcodeItem from the first server in the chain that looks the
+// barcode up in Alma
+func (s *ChainServer) LookupAlma(barcode string) (*BarcodeItem, error) {
+	for _, server := range s.servers {
+		if x, ok := server.(AlmaLookupInterface); ok && x.HasAlma() {
+			result, err := x.LookupAlma(barcode)
+			if err != errNoAlma { return result, err }
+		}
+	}
+	return nil, errNoAlma
+}
+
+// Returns false if any server in the chain has exhausted its quota
+func (s *ChainServer) QuotaLeft(barcode string) (bool) {
+	for _, server := range s.servers {
+		if x, ok := server.(QuotaCheckInterface); ok && !x.QuotaLeft(barcode) { return false }
+	}
+	return true
+}
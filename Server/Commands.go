@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+//
+// Server subcommands, run in place of the web server when named on the
+// command line after any flags, e.g. "go run . -db_type sqlite reextract"
+//
+
+type commandFunc func(args []string, localServer BarcodeServerInterface, remoteServer BarcodeServerInterface) error
+
+var commands = map[string]commandFunc {}
+
+func init() {
+	commands["reextract"] = reextractCommand
+}
+
+// Runs the command named in args[0], passing on the remaining arguments
+func runCommand(args []string, localServer BarcodeServerInterface, remoteServer BarcodeServerInterface) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		names := []string {}
+		for name := range commands { names = append(names,name) }
+		sort.Strings(names)
+		return fmt.Errorf("unknown command '%s' (available: %s)", args[0], strings.Join(names,", "))
+	}
+
+	return cmd(args[1:],localServer,remoteServer)
+}
+
+//
+// Re-derives the normalized BarcodeItem fields from stored raw payloads,
+// without contacting any upstream server.
+//
+
+func reextractCommand(args []string, localServer BarcodeServerInterface, _ BarcodeServerInterface) error {
+	flags := flag.NewFlagSet("reextract", flag.ContinueOnError)
+	dryRun := flags.Bool("dry_run", false, "Report changes without updating the cache.")
+	if err := flags.Parse(args); err != nil { return err }
+
+	rawServer, ok := localServer.(RawStoreInterface)
+	if !ok { return fmt.Errorf("local server does not store raw payloads") }
+
+	seen, changed, skipped := 0, 0, 0
+
+	rawServer.EachRaw( func(barcode, source string, raw []byte) {
+		seen++
+
+		extractor, ok := extractors[source]
+		if !ok {
+			skipped++
+			return
+		}
+
+		item := extractor.Extract(barcode,raw)
+		if item == nil {
+			log.Println("Unable to re-extract barcode \""+barcode+"\"")
+			skipped++
+			return
+		}
+
+		diffs := diffItems(localServer.Lookup(barcode),item)
+		if len(diffs) == 0 { return }
+
+		log.Println("Re-extracted \""+barcode+"\":",strings.Join(diffs,"; "))
+		changed++
+
+		if !*dryRun { rawServer.Update(item) }
+	})
+
+	log.Println(fmt.Sprintf("Re-extract: %d payloads, %d changed, %d skipped", seen, changed, skipped))
+	return nil
+}
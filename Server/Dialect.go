@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+// SQL dialects. The SQL server runs the same statements on every database,
+// written with '?' variables and placeholders such as {limit}; a Dialect
+// supplies the parts that differ. Dialects register themselves by -db_type
+// name (see SQLite.go, Postgres.go and MySQL.go), so adding a database only
+// needs a new Dialect, e.g. Oracle with ":n" variables and FETCH NEXT paging.
+//
+
+type Dialect interface {
+	// Returns the connection parameters for the database flags, or for the
+	// connection URL where one is given
+	Params(c DBConfig) (string, error)
+
+	// Opens the database given by the connection parameters
+	Open(params string) (*sql.DB, error)
+
+	// Opens a separate pool of connections for reads, for databases that
+	// allow a single writer at a time (SQLite): writes are then made by one
+	// goroutine, batching them into transactions, on a single connection.
+	// Returns nil if reads and writes share the pool opened by Open().
+	OpenReader(params string) (*sql.DB, error)
+
+	// Variable n (from 1) of a prepared statement, e.g. "?" or "$1"
+	Placeholder(n int) string
+
+	// Type of an auto-incremented integer primary key, without "PRIMARY KEY"
+	IdentityType() string
+
+	// Type of a binary column, and a variable holding a value for it
+	BlobType() string
+	BlobVar() string
+
+	// Definition of the (non-null) search text column, added to old tables
+	TextColumn() string
+
+	// Statement changing a column of a table to the TextColumn() type, for
+	// columns old tables have as varchar; empty if column types do not limit
+	// length
+	AlterToText(table string, column string) string
+
+	// Expression naming the schema tables are created in, to find them in
+	// information_schema; empty where there is none
+	CurrentSchema() string
+
+	// Expression concatenating the SQL expressions
+	Concat(exprs ...string) string
+
+	// Expression ordering rows at random
+	Random() string
+
+	// Paging clause, with variables for the limit and (optionally) offset
+	Limit(offset bool) string
+
+	// Clause resolving an insert that collides with an existing row on the
+	// unique key column, according to policy: "skip" keeps the existing row,
+	// "overwrite" replaces its columns, and "newest" replaces them only if
+	// the new row was fetched later. The columns end with "fetched".
+	Upsert(table string, key string, columns []string, policy string) string
+
+	// Full-text search used: "fts5", "tsvector", "fulltext" or "like"
+	TextSearch() string
+
+	// Returns true if err is a transient failure caused by concurrent writers
+	// (deadlock, serialization failure or busy database), worth retrying
+	Retryable(err error) bool
+}
+
+var dialects = map[string]Dialect {}
+
+// Registers a dialect under a database type name, e.g. from an init() function
+func registerDialect(name string, dialect Dialect) {
+	dialects[strings.ToLower(name)] = dialect
+}
+
+// Returns the dialect registered for a database type
+func lookupDialect(name string) (Dialect, error) {
+	dialect, ok := dialects[strings.ToLower(name)]
+	if !ok { return nil, fmt.Errorf("Unknown database type %s (use %s)", name, strings.Join(dialectNames(),"|")) }
+	return dialect, nil
+}
+
+func dialectNames() ([]string) {
+	names := []string {}
+	for name := range dialects { names = append(names,name) }
+	sort.Strings(names)
+	return names
+}
+
+// Replaces each '?' variable in src with the dialect's placeholder
+func bindVars(src string, dialect Dialect) (string) {
+	builder := strings.Builder {}
+	varIndex := 1
+	for _,r := range src {
+		if r == '?' {
+			builder.WriteString(dialect.Placeholder(varIndex))
+			varIndex++
+		} else {
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
+
+// Upsert clause in the form shared by SQLite (3.24 or later) and Postgres
+func onConflict(table string, key string, columns []string, policy string) (string) {
+	if policy == "skip" { return "ON CONFLICT("+key+") DO NOTHING" }
+
+	set := []string {}
+	for _, c := range columns { set = append(set,c+"=excluded."+c) }
+
+	clause := "ON CONFLICT("+key+") DO UPDATE SET "+strings.Join(set,",")
+	if policy == "newest" { clause += " WHERE "+table+".fetched<excluded.fetched" }
+	return clause
+}
+
+//
+// Database connection settings, from the -db_* flags
+//
+
+type DBConfig struct {
+	URL string // full connection URL, used instead of the fields below
+	Name, User, Pass, Host, Port string
+	TLS string // "" (as in the URL, else disabled), "disable", "require", "verify-ca" or "verify-full"
+	TLSCA, TLSCert, TLSKey string // PEM file paths (optional)
+}
+
+// Limits of a connection pool; zero values leave the driver's defaults
+type poolLimits struct {
+	maxOpen int // 0 = unlimited
+	maxIdle int
+	lifetime time.Duration // 0 = connections are reused forever
+}
+
+// Returns true if the connection should use TLS
+func (c DBConfig) UseTLS() (bool) {
+	return c.TLS != "" && c.TLS != "disable"
+}
+
+// Returns a TLS configuration for the TLS settings, in the sense of
+// Postgres's sslmode: "require" encrypts without checking the server's
+// certificate, "verify-ca" checks it was signed by the CA and "verify-full"
+// also checks it is for the host. The CA defaults to the system's roots.
+func (c DBConfig) TLSConfig() (*tls.Config, error) {
+	config := &tls.Config {}
+
+	var roots *x509.CertPool
+	if c.TLSCA != "" {
+		pem, err := ioutil.ReadFile(c.TLSCA)
+		if err != nil { return nil, err }
+
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) { return nil, fmt.Errorf("No certificates found in %s", c.TLSCA) }
+	}
+
+	if c.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCert,c.TLSKey)
+		if err != nil { return nil, err }
+		config.Certificates = []tls.Certificate {cert}
+	}
+
+	switch c.TLS {
+		case "require":
+			config.InsecureSkipVerify = true
+
+		case "verify-ca":
+			// Verified here rather than by crypto/tls, which always checks the host
+			config.InsecureSkipVerify = true
+			config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				certs := []*x509.Certificate {}
+				for _, raw := range rawCerts {
+					cert, err := x509.ParseCertificate(raw)
+					if err != nil { return err }
+					certs = append(certs,cert)
+				}
+				if len(certs) == 0 { return fmt.Errorf("No server certificate") }
+
+				opts := x509.VerifyOptions { Roots: roots, Intermediates: x509.NewCertPool() }
+				for _, cert := range certs[1:] { opts.Intermediates.AddCert(cert) }
+				_, err := certs[0].Verify(opts)
+				return err
+			}
+
+		case "verify-full":
+			// The drivers set the server name to the host connected to
+			config.RootCAs = roots
+
+		default:
+			return nil, fmt.Errorf("Unknown TLS mode %s (use disable|require|verify-ca|verify-full)", c.TLS)
+	}
+
+	return config, nil
+}
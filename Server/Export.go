@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+//
+// Export and import of the cache as CSV or JSON Lines, e.g. to seed a new
+// branch server or to hand data to cataloguers. Both stream, a page or a
+// batch at a time, so they work on caches of any size. Raw upstream payloads
+// are optional in exports (base64 encoded), and kept by imports if present.
+//
+
+// Counts of imported items, by outcome
+type ImportResult struct {
+	Inserted int `json:"inserted"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"` // Already present, and kept
+	Rejected int `json:"rejected"` // Invalid records, or items rejected while the database was down
+}
+
+// Items are exported in barcode order, a page at a time
+const exportPageSize = 500
+
+// Columns of the CSV format; JSON Lines records use the same names
+var exportColumns = []string {"barcode", "isbn", "author", "title", "source", "symbology", "fetched", "raw"}
+
+// Record format for JSON Lines; as BarcodeItem, plus the raw payload
+type exportRecord struct {
+	*BarcodeItem
+	Raw []byte `json:"raw,omitempty"`
+}
+
+// Returns the format implied by a file name, if not given explicitly
+func exportFormat(format string, fileName string) (string, error) {
+	if format == "" {
+		format = "jsonl"
+		if strings.HasSuffix(strings.ToLower(fileName),".csv") { format = "csv" }
+	}
+
+	switch format {
+		case "csv", "jsonl": return format, nil
+	}
+	return "", fmt.Errorf("unknown format '%s' (use csv or jsonl)", format)
+}
+
+// Writes the items matching the query's filters, returning the number written.
+// Raw payloads are included if rawServer is not nil.
+func exportItems(w io.Writer, format string, lister ListInterface, rawServer RawStoreInterface, query ListQuery) (int, error) {
+	query.Sort, query.Descending, query.Limit = "barcode", false, exportPageSize
+
+	buffered := bufio.NewWriter(w)
+	csvWriter := csv.NewWriter(buffered)
+	encoder := json.NewEncoder(buffered)
+
+	columns := exportColumns
+	if rawServer == nil { columns = columns[:len(columns)-1] }
+
+	if format == "csv" {
+		if err := csvWriter.Write(columns); err != nil { return 0, err }
+	}
+
+	count := 0
+
+	for {
+		items := lister.List(query)
+
+		for _, item := range items {
+			record := exportRecord { BarcodeItem: item }
+			if rawServer != nil { record.Raw, _ = rawServer.LookupRaw(item.Barcode) }
+
+			var err error
+			if format == "csv" {
+				fetched := ""
+				if item.Fetched != nil { fetched = item.Fetched.Format(time.RFC3339) }
+
+				row := []string {item.Barcode, item.ISBN, item.Author, item.Title, item.Source, item.Symbology, fetched}
+				if rawServer != nil { row = append(row,base64.StdEncoding.EncodeToString(record.Raw)) }
+
+				err = csvWriter.Write(row)
+			} else {
+				err = encoder.Encode(&record)
+			}
+			if err != nil { return count, err }
+
+			count++
+		}
+
+		if len(items) < query.Limit { break }
+		query.After = &ListCursor { Barcode: items[len(items)-1].Barcode }
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil { return count, err }
+
+	return count, buffered.Flush()
+}
+
+// Returns a valid item from an imported record, or an error describing why not
+func importItem(record exportRecord) (*BarcodeItem, error) {
+	if record.BarcodeItem == nil { return nil, fmt.Errorf("empty record") }
+
+	item := *record.BarcodeItem
+	item.Raw = record.Raw
+
+	barcode, symbology, err := normalizeBarcode(item.Barcode)
+	if err != nil { return nil, fmt.Errorf("barcode \"%s\": %v", item.Barcode, err) }
+
+	if len(item.Source) > 50 { return nil, fmt.Errorf("barcode \"%s\": source too long", barcode) }
+
+	item.Barcode, item.Symbology = barcode, symbology
+	normalizeISBNs(&item)
+
+	return &item, nil
+}
+
+// Returns a function reading successive records from a CSV or JSON Lines
+// stream; it returns io.EOF at the end.
+func importReader(r io.Reader, format string) (func() (exportRecord, error), error) {
+	if format == "jsonl" {
+		decoder := json.NewDecoder(bufio.NewReader(r))
+		return func() (exportRecord, error) {
+			record := exportRecord {}
+			err := decoder.Decode(&record)
+			return record, err
+		}, nil
+	}
+
+	reader := csv.NewReader(bufio.NewReader(r))
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil { return nil, fmt.Errorf("unable to read CSV header: %v", err) }
+
+	index := map[string]int {}
+	for i, name := range header { index[strings.ToLower(strings.TrimSpace(name))] = i }
+	if _, ok := index["barcode"]; !ok { return nil, fmt.Errorf("CSV header has no barcode column") }
+
+	return func() (exportRecord, error) {
+		row, err := reader.Read()
+		if err != nil { return exportRecord {}, err }
+
+		field := func(name string) string {
+			if i, ok := index[name]; ok && i < len(row) { return row[i] }
+			return ""
+		}
+
+		item := &BarcodeItem {
+			Barcode: field("barcode"),
+			ISBN: field("isbn"),
+			Author: field("author"),
+			Title: field("title"),
+			Source: field("source"),
+		}
+
+		if v := field("fetched"); v != "" {
+			t, err := time.Parse(time.RFC3339,v)
+			if err != nil { return exportRecord {}, fmt.Errorf("barcode \"%s\": invalid fetched time", item.Barcode) }
+			item.Fetched = &t
+		}
+
+		record := exportRecord { BarcodeItem: item }
+		if v := field("raw"); v != "" {
+			if record.Raw, err = base64.StdEncoding.DecodeString(v); err != nil {
+				return exportRecord {}, fmt.Errorf("barcode \"%s\": invalid raw payload", item.Barcode)
+			}
+		}
+
+		return record, nil
+	}, nil
+}
+
+// Reads items from a CSV or JSON Lines stream into the local server, in
+// batches of the given size (one transaction each). Invalid records are
+// logged and counted; malformed files stop the import, as does a database
+// error (returned as a *DatabaseError).
+func importItems(r io.Reader, format string, importer ImportInterface, policy string, batchSize int) (ImportResult, error) {
+	result := ImportResult {}
+
+	switch policy {
+		case "skip", "overwrite", "newest":
+		default: return result, fmt.Errorf("unknown conflict policy '%s' (use skip, overwrite or newest)", policy)
+	}
+	if batchSize < 1 { return result, fmt.Errorf("batch size must be at least 1") }
+
+	next, err := importReader(r,format)
+	if err != nil { return result, err }
+
+	batch := []*BarcodeItem {}
+
+	flush := func() (error) {
+		if len(batch) == 0 { return nil }
+
+		stored, err := importer.Import(batch,policy)
+		result.Inserted += stored.Inserted
+		result.Updated += stored.Updated
+		result.Skipped += stored.Skipped
+		result.Rejected += stored.Rejected
+
+		batch = batch[:0]
+		if err != nil { return &DatabaseError { msg: "Unable to import items", err: err } }
+		return nil
+	}
+
+	for {
+		record, err := next()
+		if err == io.EOF { break }
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok || format == "jsonl" {
+				if dbErr := flush(); dbErr != nil { return result, dbErr }
+				return result, err
+			}
+
+			log.Println("Import: ",err)
+			result.Rejected++
+			continue
+		}
+
+		item, err := importItem(record)
+		if err != nil {
+			log.Println("Import: ",err)
+			result.Rejected++
+			continue
+		}
+
+		batch = append(batch,item)
+		if len(batch) >= batchSize {
+			if err := flush(); err != nil { return result, err }
+		}
+	}
+
+	return result, flush()
+}
+
+//
+// Commands
+//
+
+func init() {
+	commands["export"] = exportCommand
+	commands["import"] = importCommand
+}
+
+// Writes the cache (or the items matching the filters) to a file, or stdout
+func exportCommand(args []string, localServer BarcodeServerInterface, _ BarcodeServerInterface) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "", "Output format, csv|jsonl (empty = from file name; default jsonl).")
+	withRaw := flags.Bool("raw", false, "Include raw upstream payloads (base64).")
+	source := flags.String("source", "", "Only items from this upstream.")
+	missing := flags.String("missing", "", "Only items missing this field (isbn, author or title).")
+	authorPrefix := flags.String("author_prefix", "", "Only items with authors starting with this.")
+	fetchedSince := flags.String("fetched_since", "", "Only items fetched since this time (RFC 3339 or Unix seconds).")
+	if err := flags.Parse(args); err != nil { return err }
+
+	fileName := flags.Arg(0)
+	f, err := exportFormat(*format,fileName)
+	if err != nil { return err }
+
+	query, err := parseListQuery(url.Values {
+		"source": {*source},
+		"missing": {*missing},
+		"author_prefix": {*authorPrefix},
+		"fetched_since": {*fetchedSince},
+	})
+	if err != nil { return err }
+
+	lister, ok := localServer.(ListInterface)
+	if !ok { return fmt.Errorf("local server does not support listing") }
+
+	var rawServer RawStoreInterface
+	if *withRaw {
+		if rawServer, ok = localServer.(RawStoreInterface); !ok { return fmt.Errorf("local server does not store raw payloads") }
+	}
+
+	out := os.Stdout
+	if fileName != "" && fileName != "-" {
+		if out, err = os.Create(fileName); err != nil { return err }
+		defer out.Close()
+	}
+
+	n, err := exportItems(out,f,lister,rawServer,query)
+	if err != nil { return err }
+
+	log.Println(fmt.Sprintf("Export: %d items", n))
+	return nil
+}
+
+// Reads items from a file, or stdin
+func importCommand(args []string, localServer BarcodeServerInterface, _ BarcodeServerInterface) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "", "Input format, csv|jsonl (empty = from file name; default jsonl).")
+	policy := flags.String("conflict", "skip", "Items already cached: skip|overwrite|newest.")
+	batchSize := flags.Int("batch", 500, "Items stored per transaction.")
+	if err := flags.Parse(args); err != nil { return err }
+
+	fileName := flags.Arg(0)
+	f, err := exportFormat(*format,fileName)
+	if err != nil { return err }
+
+	importer, ok := localServer.(ImportInterface)
+	if !ok { return fmt.Errorf("local server does not support importing") }
+
+	in := os.Stdin
+	if fileName != "" && fileName != "-" {
+		if in, err = os.Open(fileName); err != nil { return err }
+		defer in.Close()
+	}
+
+	result, err := importItems(in,f,importer,*policy,*batchSize)
+	log.Println(fmt.Sprintf("Import: %d inserted, %d updated, %d skipped, %d rejected",
+		result.Inserted, result.Updated, result.Skipped, result.Rejected))
+	return err
+}
+
+//
+// Admin endpoints, which require the -admin_token value in the X-Admin-Token
+// header; they are disabled if no token is set.
+//
+
+func adminOnly(token string, fn handlerFunc) (handlerFunc) {
+	return func(w http.ResponseWriter, r *http.Request, localServer BarcodeServerInterface, remoteServer BarcodeServerInterface) {
+		given := r.Header.Get("X-Admin-Token")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given),[]byte(token)) != 1 {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		fn(w,r,localServer,remoteServer)
+	}
+}
+
+// Streams the cache (or the items matching the listing filters) as
+// ?format=csv|jsonl, with raw payloads if ?raw=1
+func exportHandler(w http.ResponseWriter, r *http.Request, localServer BarcodeServerInterface, _ BarcodeServerInterface) {
+	log.Println(fmt.Sprintf("Incoming on %s : export \"%s\" (from %s)",r.URL.Path,r.URL.RawQuery,r.RemoteAddr))
+
+	format, err := exportFormat(r.URL.Query().Get("format"),"")
+	query := ListQuery {}
+	if err == nil { query, err = parseListQuery(r.URL.Query()) }
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.After = nil
+
+	lister, ok := localServer.(ListInterface)
+	rawServer, hasRaw := localServer.(RawStoreInterface)
+	withRaw := r.URL.Query().Get("raw") != ""
+
+	if !ok || (withRaw && !hasRaw) {
+		http.Error(w, "Export not supported by local server", http.StatusNotImplemented)
+		return
+	}
+	if cacheUnavailable(w,localServer) { return }
+	if !withRaw { rawServer = nil }
+
+	contentType := "application/x-ndjson"
+	if format == "csv" { contentType = "text/csv" }
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=barcodes."+format)
+
+	// Once streaming has started, errors can only be logged
+	n, err := exportItems(w,format,lister,rawServer,query)
+	if err != nil { log.Println("Export failed: ",err) }
+	log.Println(fmt.Sprintf("Export: %d items", n))
+}
+
+// Imports the request body (?format=csv|jsonl), with ?conflict=skip|overwrite|newest
+func importHandler(w http.ResponseWriter, r *http.Request, localServer BarcodeServerInterface, _ BarcodeServerInterface) {
+	log.Println(fmt.Sprintf("Incoming on %s : import \"%s\" (from %s)",r.URL.Path,r.URL.RawQuery,r.RemoteAddr))
+
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	format, err := exportFormat(r.URL.Query().Get("format"),"")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	policy := r.URL.Query().Get("conflict")
+	if policy == "" { policy = "skip" }
+
+	importer, ok := localServer.(ImportInterface)
+	if !ok {
+		http.Error(w, "Import not supported by local server", http.StatusNotImplemented)
+		return
+	}
+	if cacheUnavailable(w,localServer) { return }
+
+	result, err := importItems(r.Body,format,importer,policy,500)
+
+	status := struct {
+		ImportResult
+		Error string `json:"error,omitempty"`
+	} {
+		ImportResult: result,
+	}
+
+	// The file is at fault, unless the database failed
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		log.Println("Import failed: ",err)
+		status.Error = err.Error()
+
+		var dbErr *DatabaseError
+		if errors.As(err,&dbErr) {
+			w.WriteHeader(http.StatusInternalServerError)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(&status); err != nil { log.Println("Unable to write import result: ",err) }
+}
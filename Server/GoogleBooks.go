@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//
+// BarcodeServerInterface implementation using the Google Books volumes API.
+// Only barcodes that are themselves ISBNs can be looked up.
+//
+
+type GoogleBooksServer struct {
+	api string // Base URL, e.g. https://www.googleapis.com
+	key string // Optional API key
+}
+
+// BarcodeItem.Source for items fetched from Google Books
+const googleBooksSource = "googlebooks"
+
+func init() {
+	extractors[googleBooksSource] = &GoogleBooksServer {}
+}
+
+// params = base URL of the API (empty = public Google server)
+func (s *GoogleBooksServer) Startup(params string) {
+	s.api = strings.TrimSuffix(params,"/")
+	if s.api == "" { s.api = "https://www.googleapis.com" }
+}
+
+// Dummy function (included to satisfy BarcodeServerInterface)
+func (s *GoogleBooksServer) Shutdown() {}
+
+// Returns a BarcodeItem using Google Books, if the barcode is an ISBN
+func (s *GoogleBooksServer) Lookup(barcode string) (*BarcodeItem) {
+	isbn, ok := isbnFromBarcode(barcode)
+	if !ok { return nil }
+
+	query := url.Values {}
+	query.Set("q", "isbn:"+isbn)
+	if s.key != "" { query.Set("key", s.key) }
+
+	URL := fmt.Sprintf("%s/books/v1/volumes?%s", s.api, query.Encode())
+
+	req, err := http.NewRequest("GET",URL,nil)
+	boom(err,"Unable to create HTTP request")
+	req.Header.Set("Accept", "application/json")
+
+	body := fetchBody(req,"Google Books")
+	if body == nil { return nil }
+
+	result := s.Extract(barcode,body)
+	if result != nil { result.Raw = body }
+
+	return result
+}
+
+// Returns a BarcodeItem built from a raw Google Books volumes response
+func (s *GoogleBooksServer) Extract(barcode string, raw []byte) (*BarcodeItem) {
+	var m struct {
+		Items []struct {
+			VolumeInfo struct {
+				Title string `json:"title"`
+				Subtitle string `json:"subtitle"`
+				Authors []string `json:"authors"`
+				Identifiers []struct {
+					Type string `json:"type"`
+					Identifier string `json:"identifier"`
+				} `json:"industryIdentifiers"`
+			} `json:"volumeInfo"`
+		} `json:"items"`
+	}
+
+	if err := json.Unmarshal(raw,&m); err != nil {
+		log.Println("Unable to decode Google Books json data!")
+		return nil
+	}
+
+	if len(m.Items) < 1 { return nil }
+
+	info := m.Items[0].VolumeInfo
+	result := BarcodeItem {
+		Barcode: barcode,
+		Source: googleBooksSource,
+		Author: strings.Join(info.Authors,"; "),
+		Title: info.Title,
+	}
+	if info.Subtitle != "" { result.Title += ": "+info.Subtitle }
+
+	// Prefer ISBN-13 where both forms are given
+	result.ISBN, _ = isbnFromBarcode(barcode)
+	for _, id := range info.Identifiers {
+		if id.Type == "ISBN_13" { result.ISBN = id.Identifier; break }
+		if id.Type == "ISBN_10" { result.ISBN = id.Identifier }
+	}
+
+	return &result
+}
+
+// Dummy function (included to satisfy BarcodeServerInterface)
+func (s *GoogleBooksServer) Store(info *BarcodeItem) {
+	log.Println("Store called on read-only Google Books server!")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+)
+
+//
+// ISBN parsing and validation. Upstreams return ISBNs in mixed forms, e.g.
+// "0-261-10334-2 (pbk.) ; 9780261103344", so we extract every valid ISBN from
+// such a string and keep a canonical ISBN-13 list alongside the original.
+//
+
+// Both forms of an ISBN; ISBN-10 is empty for 979 ISBNs, which have none
+type ISBNForms struct {
+	ISBN13 string `json:"isbn13"`
+	ISBN10 string `json:"isbn10,omitempty"`
+}
+
+// Returns true if s is a ISBN-10 (digits only, bar a final X) with a valid check digit
+func validISBN10(s string) (bool) {
+	if len(s) != 10 { return false }
+
+	sum := 0
+	for i, r := range s {
+		var d int
+		switch {
+			case r >= '0' && r <= '9': d = int(r-'0')
+			case r == 'X' && i == 9: d = 10
+			default: return false
+		}
+		sum += (10-i) * d
+	}
+
+	return sum%11 == 0
+}
+
+// Returns true if s is a 13-digit EAN with a valid check digit
+func validEAN13(s string) (bool) {
+	if len(s) != 13 { return false }
+
+	sum := 0
+	for i, r := range s {
+		if r < '0' || r > '9' { return false }
+		d := int(r-'0')
+		if i%2 == 1 { d *= 3 }
+		sum += d
+	}
+
+	return sum%10 == 0
+}
+
+// Returns true if s is a valid ISBN-13, i.e. a valid EAN-13 in the 978/979 range
+func validISBN13(s string) (bool) {
+	return validEAN13(s) && (strings.HasPrefix(s,"978") || strings.HasPrefix(s,"979"))
+}
+
+// Converts a valid ISBN-10 into ISBN-13
+func isbn10To13(s string) (string) {
+	body := "978" + s[:9]
+
+	sum := 0
+	for i, r := range body {
+		d := int(r-'0')
+		if i%2 == 1 { d *= 3 }
+		sum += d
+	}
+
+	return body + string(rune('0' + (10-sum%10)%10))
+}
+
+// Converts a valid ISBN-13 into ISBN-10; empty if there is no equivalent
+func isbn13To10(s string) (string) {
+	if !strings.HasPrefix(s,"978") { return "" }
+	body := s[3:12]
+
+	sum := 0
+	for i, r := range body { sum += (10-i) * int(r-'0') }
+
+	check := (11 - sum%11) % 11
+	if check == 10 { return body + "X" }
+	return body + string(rune('0'+check))
+}
+
+// Returns the canonical ISBN-13 for a string holding one ISBN, ignoring hyphens and spaces
+func parseISBN(s string) (string, bool) {
+	s = strings.ToUpper(strings.NewReplacer("-","", " ","").Replace(s))
+
+	switch {
+		case validISBN13(s): return s, true
+		case validISBN10(s): return isbn10To13(s), true
+	}
+
+	return "", false
+}
+
+// Returns the canonical ISBN-13 of every valid ISBN in a string, without
+// duplicates. ISBNs may be hyphenated, and separated by anything else.
+func parseISBNs(s string) ([]string) {
+	tokens := strings.FieldsFunc(s, func(r rune) bool {
+		return !((r >= '0' && r <= '9') || r == 'X' || r == 'x' || r == '-')
+	})
+
+	isbns := []string {}
+	seen := map[string]bool {}
+
+	for _, token := range tokens {
+		isbn, ok := parseISBN(token)
+		if !ok || seen[isbn] { continue }
+
+		seen[isbn] = true
+		isbns = append(isbns,isbn)
+	}
+
+	return isbns
+}
+
+// Returns both forms of each canonical ISBN-13
+func isbnForms(isbns []string) ([]ISBNForms) {
+	forms := []ISBNForms {}
+	for _, isbn := range isbns {
+		forms = append(forms, ISBNForms { ISBN13: isbn, ISBN10: isbn13To10(isbn) })
+	}
+	return forms
+}
+
+// Sets the item's canonical ISBN list from its ISBN string
+func normalizeISBNs(item *BarcodeItem) {
+	if item == nil { return }
+	item.ISBNs = isbnForms(parseISBNs(item.ISBN))
+}
+
+// Returns the barcode as an ISBN (ISBN-10, or ISBN-13 in the 978/979
+// range) if it is one, ignoring hyphens and spaces.
+func isbnFromBarcode(barcode string) (string, bool) {
+	isbn := strings.ToUpper(strings.NewReplacer("-","", " ","").Replace(barcode))
+	return isbn, validISBN13(isbn) || validISBN10(isbn)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+//
+// ISBN check digits, and conversion between ISBN-10 and ISBN-13
+//
+
+func TestISBNCheckDigits(t *testing.T) {
+	tests := []struct {
+		isbn string
+		valid10, valid13 bool
+	} {
+		{"0261103342", true, false},
+		{"0261103343", false, false},
+		{"080442957X", true, false},
+		{"0804429579", false, false},
+		{"X804429570", false, false}, // X only as the check digit
+		{"9780261103344", false, true},
+		{"9780261103345", false, false},
+		{"9791032305690", false, true},
+		{"4006381333931", false, false}, // A valid EAN-13, but not an ISBN
+		{"026110334", false, false},
+	}
+
+	for _, test := range tests {
+		if got := validISBN10(test.isbn); got != test.valid10 {
+			t.Errorf("validISBN10(%q) = %v, want %v", test.isbn, got, test.valid10)
+		}
+		if got := validISBN13(test.isbn); got != test.valid13 {
+			t.Errorf("validISBN13(%q) = %v, want %v", test.isbn, got, test.valid13)
+		}
+	}
+
+	if !validEAN13("4006381333931") || validEAN13("4006381333932") {
+		t.Errorf("validEAN13 misjudged the check digit of 4006381333931")
+	}
+}
+
+func TestISBNConversion(t *testing.T) {
+	tests := []struct {
+		isbn10, isbn13 string
+	} {
+		{"0261103342", "9780261103344"},
+		{"080442957X", "9780804429573"},
+		{"0306406152", "9780306406157"},
+	}
+
+	for _, test := range tests {
+		if got := isbn10To13(test.isbn10); got != test.isbn13 {
+			t.Errorf("isbn10To13(%q) = %q, want %q", test.isbn10, got, test.isbn13)
+		}
+		if got := isbn13To10(test.isbn13); got != test.isbn10 {
+			t.Errorf("isbn13To10(%q) = %q, want %q", test.isbn13, got, test.isbn10)
+		}
+	}
+
+	// 979 ISBNs have no ISBN-10
+	if got := isbn13To10("9791032305690"); got != "" {
+		t.Errorf("isbn13To10(9791032305690) = %q, want none", got)
+	}
+}
+
+func TestParseISBNs(t *testing.T) {
+	tests := []struct {
+		s string
+		want []string
+	} {
+		{"0-261-10334-2 (pbk.) ; 9780261103344", []string {"9780261103344"}},
+		{"080442957x", []string {"9780804429573"}},
+		{"978-0-306-40615-7 ; 0-261-10334-3", []string {"9780306406157"}},
+		{"no ISBN here", []string {}},
+	}
+
+	for _, test := range tests {
+		if got := parseISBNs(test.s); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseISBNs(%q) = %v, want %v", test.s, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+// Items as kept by key-value backends (bbolt, Redis), which have no query
+// language: searching, listing and finding stale items scan all the items,
+// in barcode order, with the same results as the SQL backends.
+//
+
+// Stored form of an item; the raw payload is compressed
+type kvItem struct {
+	Barcode string `json:"b"`
+	ISBN string `json:"i"`
+	Author string `json:"a"`
+	Title string `json:"t"`
+	Source string `json:"s,omitempty"`
+	Symbology string `json:"y,omitempty"`
+	ISBNs []string `json:"n,omitempty"` // canonical ISBN-13s
+	Search string `json:"q,omitempty"` // folded title and author
+	Raw []byte `json:"r,omitempty"`
+	Fetched int64 `json:"f,omitempty"`
+	Hits int64 `json:"h,omitempty"`
+	Accessed int64 `json:"x,omitempty"`
+}
+
+// Returns the stored form of an item, fetched now unless it says otherwise
+func newKVItem(item *BarcodeItem) (*kvItem, error) {
+	b := &kvItem {
+		Barcode: item.Barcode, ISBN: item.ISBN, Author: item.Author, Title: item.Title,
+		Source: item.Source, Symbology: barcodeSymbology(item.Barcode),
+		ISBNs: parseISBNs(item.ISBN), Search: searchText(item),
+		Fetched: time.Now().Unix(),
+	}
+	if item.Fetched != nil { b.Fetched = item.Fetched.Unix() }
+
+	var err error
+	b.Raw, err = compress(item.Raw)
+	return b, err
+}
+
+func (b *kvItem) item() (*BarcodeItem) {
+	item := BarcodeItem {
+		Barcode: b.Barcode, ISBN: b.ISBN, Author: b.Author, Title: b.Title,
+		ISBNs: isbnForms(b.ISBNs), Symbology: b.Symbology, Source: b.Source,
+	}
+	if b.Fetched > 0 {
+		t := time.Unix(b.Fetched,0).UTC()
+		item.Fetched = &t
+	}
+	return &item
+}
+
+func kvItems(found []*kvItem, offset int, limit int) ([]*BarcodeItem) {
+	items := []*BarcodeItem {}
+	for i := offset; i < len(found) && len(items) < limit; i++ { items = append(items,found[i].item()) }
+	return items
+}
+
+// Returns the items whose search text contains every term, by title
+func kvSearch(all []*kvItem, terms []string, limit, offset int) ([]*BarcodeItem) {
+	found := []*kvItem {}
+
+	next:
+	for _, b := range all {
+		for _, t := range terms {
+			if !strings.Contains(b.Search,t) { continue next }
+		}
+		found = append(found,b)
+	}
+
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Title < found[j].Title })
+	return kvItems(found,offset,limit)
+}
+
+// Returns a page of the items, as for ListInterface
+func kvList(all []*kvItem, q ListQuery) ([]*BarcodeItem) {
+	// Sort column value, compared as a string or a number
+	value := func(b *kvItem) (string, int64) {
+		switch q.Sort {
+			case "title": return b.Title, 0
+			case "author": return b.Author, 0
+			case "fetched": return "", b.Fetched
+		}
+		return "", 0
+	}
+
+	// Compares items by (sort column, barcode), as for the cursor
+	compare := func(v string, n int64, barcode string, w string, m int64, other string) int {
+		switch {
+			case v < w || (v == w && n < m): return -1
+			case v > w || (v == w && n > m): return 1
+		}
+		return strings.Compare(barcode,other)
+	}
+
+	var afterValue string
+	var afterNumber int64
+	if q.After != nil {
+		if q.Sort == "fetched" {
+			fmt.Sscan(q.After.Value,&afterNumber)
+		} else if q.Sort != "barcode" {
+			afterValue = q.After.Value
+		}
+	}
+
+	authorPrefix := strings.ToLower(q.AuthorPrefix)
+
+	found := []*kvItem {}
+	for _, b := range all {
+		switch {
+			case q.Source != "" && b.Source != q.Source: continue
+			case q.Missing == "isbn" && b.ISBN != "": continue
+			case q.Missing == "author" && b.Author != "": continue
+			case q.Missing == "title" && b.Title != "": continue
+			case authorPrefix != "" && !strings.HasPrefix(strings.ToLower(b.Author),authorPrefix): continue
+			case !q.FetchedSince.IsZero() && b.Fetched < q.FetchedSince.Unix(): continue
+		}
+
+		if q.After != nil {
+			v, n := value(b)
+			c := compare(v,n,b.Barcode,afterValue,afterNumber,q.After.Barcode)
+			if (c <= 0 && !q.Descending) || (c >= 0 && q.Descending) { continue }
+		}
+
+		found = append(found,b)
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		v, n := value(found[i])
+		w, m := value(found[j])
+		c := compare(v,n,found[i].Barcode,w,m,found[j].Barcode)
+		if q.Descending { return c > 0 }
+		return c < 0
+	})
+
+	return kvItems(found,0,q.Limit)
+}
+
+// Returns up to limit items fetched before the given time, as for RefreshInterface
+func kvStale(all []*kvItem, order string, before time.Time, limit int) ([]*BarcodeItem) {
+	found := []*kvItem {}
+	for _, b := range all {
+		if b.Fetched < before.Unix() { found = append(found,b) }
+	}
+
+	// Items are already in barcode order
+	sort.SliceStable(found, func(i, j int) bool {
+		if order == "popular" && found[i].Hits != found[j].Hits { return found[i].Hits > found[j].Hits }
+		return found[i].Fetched < found[j].Fetched
+	})
+
+	return kvItems(found,0,limit)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// Paged listing of the cache contents. Pages are chained by an opaque cursor
+// holding the sort value and barcode of the last item returned, so pages stay
+// consistent while items are added, and deep pages cost no more than the first.
+//
+
+// Listing filters, ordering and page position
+type ListQuery struct {
+	Source string // Upstream the items came from
+	Missing string // "isbn", "author" or "title": only items lacking it
+	AuthorPrefix string // Case-insensitive
+	FetchedSince time.Time // Zero = any
+
+	Sort string // "barcode", "title", "author" or "fetched"
+	Descending bool
+
+	After *ListCursor // nil = first page
+	Limit int
+}
+
+// Position after the last item of a page
+type ListCursor struct {
+	Value string `json:"v"` // Sort column value
+	Barcode string `json:"b"`
+}
+
+// Returns the cursor following an item, for the given sort column
+func listCursor(item *BarcodeItem, sort string) (string) {
+	c := ListCursor { Barcode: item.Barcode }
+
+	switch sort {
+		case "title": c.Value = item.Title
+		case "author": c.Value = item.Author
+		case "fetched":
+			c.Value = "0"
+			if item.Fetched != nil { c.Value = strconv.FormatInt(item.Fetched.Unix(),10) }
+	}
+
+	data, _ := json.Marshal(&c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Returns the listing query given by the request's parameters
+func parseListQuery(params url.Values) (ListQuery, error) {
+	q := ListQuery {
+		Source: params.Get("source"),
+		Missing: params.Get("missing"),
+		AuthorPrefix: params.Get("author_prefix"),
+		Sort: strings.TrimPrefix(params.Get("sort"),"-"),
+		Descending: strings.HasPrefix(params.Get("sort"),"-"),
+		Limit: 50,
+	}
+
+	switch q.Missing {
+		case "", "isbn", "author", "title":
+		default: return q, fmt.Errorf("missing must be isbn, author or title")
+	}
+
+	switch q.Sort {
+		case "": q.Sort = "barcode"
+		case "barcode", "title", "author", "fetched":
+		default: return q, fmt.Errorf("sort must be barcode, title, author or fetched (prefix - for descending)")
+	}
+
+	// RFC 3339 time, or seconds since the epoch
+	if v := params.Get("fetched_since"); v != "" {
+		if t, err := time.Parse(time.RFC3339,v); err == nil {
+			q.FetchedSince = t
+		} else if n, err := strconv.ParseInt(v,10,64); err == nil {
+			q.FetchedSince = time.Unix(n,0)
+		} else {
+			return q, fmt.Errorf("fetched_since must be a RFC 3339 time or Unix seconds")
+		}
+	}
+
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 { return q, fmt.Errorf("limit must be 1-1000") }
+		q.Limit = n
+	}
+
+	if v := params.Get("cursor"); v != "" {
+		data, err := base64.RawURLEncoding.DecodeString(v)
+		c := ListCursor {}
+		if err == nil { err = json.Unmarshal(data,&c) }
+		if err == nil && q.Sort == "fetched" { _, err = strconv.ParseInt(c.Value,10,64) }
+		if err != nil { return q, fmt.Errorf("invalid cursor") }
+		q.After = &c
+	}
+
+	return q, nil
+}
+
+//
+// Returns a page of cached items, e.g. ?source=alma&sort=-fetched&limit=100.
+// The cursor from a page's "next_cursor" (with the same filters and sort)
+// returns the following page.
+//
+
+func listHandler(w http.ResponseWriter, r *http.Request, localServer BarcodeServerInterface, remoteServer BarcodeServerInterface) {
+	log.Println(fmt.Sprintf("Incoming on %s : list \"%s\" (from %s)",r.URL.Path,r.URL.RawQuery,r.RemoteAddr))
+
+	query, err := parseListQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lister, ok := localServer.(ListInterface)
+	if !ok {
+		http.Error(w, "Listing not supported by local server", http.StatusNotImplemented)
+		return
+	}
+	if cacheUnavailable(w,localServer) { return }
+
+	// One extra item tells us whether there is a further page
+	limit := query.Limit
+	query.Limit++
+	items := lister.List(query)
+
+	result := struct {
+		Items []*BarcodeItem `json:"items"`
+		Next string `json:"next_cursor,omitempty"`
+	} {
+		Items: items,
+	}
+
+	if len(items) > limit {
+		result.Items = items[:limit]
+		result.Next = listCursor(items[limit-1],query.Sort)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&result)
+	if err != nil { log.Println("Unable to write listing: ",err) }
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// BarcodeServerInterface implementation configured entirely from a file, so
+// new catalog APIs can be added without writing Go code, e.g.
+//
+//   {"name": "alma-eu",
+//    "url": "https://api-eu.hosted.exlibrisgroup.com/almaws/v1/items?item_barcode={barcode}",
+//    "headers": {"Accept": "application/json", "Authorization": "apikey {key}"},
+//    "fields": {"isbn": "$.bib_data.isbn", "author": "$.bib_data.author", "title": "$.bib_data.title"}}
+//
+// The URL and headers may use {barcode}, {isbn} (the barcode as an ISBN; only
+// ISBN barcodes are then looked up) and {key}, along with ${ENV} variables.
+// Fields are mapped using a JSONPath subset: $, .name, ['name'], [n], [*].
+// Where a path matches several values they are joined with "; "; [*] takes
+// an object's values in the order of their keys.
+//
+
+// Mapped upstream description, as read from the upstreams file
+type MappedConfig struct {
+	Name string `json:"name"`
+	URL string `json:"url"`
+	Key string `json:"key"`
+	Headers map[string]string `json:"headers"`
+	Fields map[string]string `json:"fields"` // BarcodeItem json name -> path
+}
+
+// Mapped upstreams by name; newUpstream() consults these too
+var mappedUpstreams = map[string]MappedConfig {}
+
+// Reads mapped upstreams from a JSON file containing a list of MappedConfig
+func loadMappedUpstreams(filePath string) (error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil { return err }
+
+	configs := []MappedConfig {}
+	if err := json.Unmarshal(data,&configs); err != nil { return err }
+
+	for _, config := range configs {
+		if config.Name == "" || config.URL == "" {
+			return fmt.Errorf("mapped upstreams need both a name and a url")
+		}
+		if upstreamNameInUse(config.Name) {
+			return fmt.Errorf("upstream name '%s' is already in use", config.Name)
+		}
+
+		for field, path := range config.Fields {
+			switch field {
+				case "isbn", "author", "title":
+				default:
+					return fmt.Errorf("upstream '%s': unknown field '%s'", config.Name, field)
+			}
+			if _, err := parseJSONPath(path); err != nil {
+				return fmt.Errorf("upstream '%s': field '%s': %v", config.Name, field, err)
+			}
+		}
+
+		mappedUpstreams[config.Name] = config
+		extractors[config.Name] = &MappedServer { config: config }
+
+		log.Println("Mapped upstream '"+config.Name+"'")
+	}
+
+	return nil
+}
+
+// Returns true if a builtin or mapped upstream has the name, ignoring case
+// as newUpstream() does for builtin kinds
+func upstreamNameInUse(name string) (bool) {
+	if strings.EqualFold(name,"parent") || strings.EqualFold(name,"random") { return true }
+	for source := range extractors {
+		if strings.EqualFold(name,source) { return true }
+	}
+	return false
+}
+
+type MappedServer struct {
+	config MappedConfig
+	key string
+}
+
+// params = API key substituted for {key} (empty = key from the config file)
+func (s *MappedServer) Startup(params string) {
+	s.key = params
+	if s.key == "" { s.key = s.config.Key }
+}
+
+// Dummy function (included to satisfy BarcodeServerInterface)
+func (s *MappedServer) Shutdown() {}
+
+// Returns a BarcodeItem from the configured upstream
+func (s *MappedServer) Lookup(barcode string) (*BarcodeItem) {
+	isbn, isISBN := isbnFromBarcode(barcode)
+	if strings.Contains(s.config.URL,"{isbn}") && !isISBN { return nil }
+
+	fill := func(template string, escape func(string) string) string {
+		return strings.NewReplacer(
+			"{barcode}", escape(barcode),
+			"{isbn}", escape(isbn),
+			"{key}", escape(s.key),
+		).Replace(os.ExpandEnv(template))
+	}
+
+	req, err := http.NewRequest("GET",fill(s.config.URL,url.QueryEscape),nil)
+	if err != nil {
+		log.Println("Unable to create request for upstream '"+s.config.Name+"': ",err)
+		return nil
+	}
+
+	for k, v := range s.config.Headers {
+		req.Header.Set(k,fill(v,func(x string) string { return x }))
+	}
+
+	body := fetchBody(req,s.config.Name)
+	if body == nil { return nil }
+
+	result := s.Extract(barcode,body)
+	if result != nil { result.Raw = body }
+
+	return result
+}
+
+// Returns a BarcodeItem built from a raw upstream response; nil if no field matched
+func (s *MappedServer) Extract(barcode string, raw []byte) (*BarcodeItem) {
+	var doc interface{}
+	if err := json.Unmarshal(raw,&doc); err != nil {
+		log.Println("Unable to decode json data from upstream '"+s.config.Name+"'!")
+		return nil
+	}
+
+	result := BarcodeItem { Barcode: barcode, Source: s.config.Name }
+	matched := false
+
+	for field, path := range s.config.Fields {
+		steps, _ := parseJSONPath(path)
+
+		values := []string {}
+		for _, v := range evalJSONPath(doc,steps) {
+			values = append(values,jsonString(v)...)
+		}
+		if len(values) == 0 { continue }
+
+		value := strings.Join(values,"; ")
+		matched = true
+
+		switch field {
+			case "isbn": result.ISBN = value
+			case "author": result.Author = value
+			case "title": result.Title = value
+		}
+	}
+
+	if !matched { return nil }
+	return &result
+}
+
+// Dummy function (included to satisfy BarcodeServerInterface)
+func (s *MappedServer) Store(info *BarcodeItem) {
+	log.Println("Store called on read-only mapped upstream!")
+}
+
+//
+// JSONPath subset. Each step is a key, an index, or "*" for all elements.
+//
+
+type jsonStep struct {
+	key string
+	index int // -1 = use key; -2 = all elements
+}
+
+func parseJSONPath(path string) ([]jsonStep, error) {
+	path = strings.TrimSpace(path)
+	if !strings.HasPrefix(path,"$") { return nil, fmt.Errorf("path must start with '$'") }
+	path = path[1:]
+
+	steps := []jsonStep {}
+
+	for len(path) > 0 {
+		switch path[0] {
+			case '.':
+				path = path[1:]
+				end := strings.IndexAny(path,".[")
+				if end < 0 { end = len(path) }
+				if end == 0 { return nil, fmt.Errorf("empty key in path") }
+
+				steps = append(steps, jsonStep { key: path[:end], index: -1 })
+				path = path[end:]
+
+			case '[':
+				end := strings.Index(path,"]")
+				if end < 0 { return nil, fmt.Errorf("unterminated '['") }
+				inner := path[1:end]
+				path = path[end+1:]
+
+				switch {
+					case inner == "*":
+						steps = append(steps, jsonStep { index: -2 })
+					case len(inner) > 1 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+						steps = append(steps, jsonStep { key: inner[1:len(inner)-1], index: -1 })
+					default:
+						n, err := strconv.Atoi(inner)
+						if err != nil || n < 0 { return nil, fmt.Errorf("bad index '%s'", inner) }
+						steps = append(steps, jsonStep { index: n })
+				}
+
+			default:
+				return nil, fmt.Errorf("unexpected '%c' in path", path[0])
+		}
+	}
+
+	return steps, nil
+}
+
+// Returns every value in doc matched by the path steps
+func evalJSONPath(doc interface{}, steps []jsonStep) ([]interface{}) {
+	current := []interface{} {doc}
+
+	for _, step := range steps {
+		next := []interface{} {}
+
+		for _, v := range current {
+			switch x := v.(type) {
+				case map[string]interface{}:
+					if step.index == -2 {
+						// In key order, so joined values are the same each time
+						keys := make([]string, 0, len(x))
+						for k := range x { keys = append(keys,k) }
+						sort.Strings(keys)
+						for _, k := range keys { next = append(next,x[k]) }
+					} else if y, ok := x[step.key]; ok && step.index == -1 {
+						next = append(next,y)
+					}
+				case []interface{}:
+					if step.index == -2 {
+						next = append(next,x...)
+					} else if step.index >= 0 && step.index < len(x) {
+						next = append(next,x[step.index])
+					}
+			}
+		}
+
+		current = next
+	}
+
+	return current
+}
+
+// Converts a matched json value into strings; arrays are flattened, objects ignored
+func jsonString(v interface{}) ([]string) {
+	switch x := v.(type) {
+		case string:
+			if x == "" { return nil }
+			return []string {x}
+		case float64:
+			return []string {strconv.FormatFloat(x,'f',-1,64)}
+		case bool:
+			return []string {strconv.FormatBool(x)}
+		case []interface{}:
+			values := []string {}
+			for _, y := range x { values = append(values,jsonString(y)...) }
+			return values
+	}
+	return nil
+}
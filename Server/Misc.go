@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 //	"hash/adler32"
+	"io"
 	"log"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"syscall"
+	"time"
 )
 
 // For when things go badly wrong
@@ -16,6 +25,109 @@ func boom (e error, msg string) {
 	}
 }
 
+// Failure of a local server's database, which need not be fatal
+type DatabaseError struct {
+	msg string
+	err error
+}
+
+func (e *DatabaseError) Error() (string) { return fmt.Sprintf("%s ( %v )",e.msg,e.err) }
+func (e *DatabaseError) Unwrap() (error) { return e.err }
+
+// Tests for errors meaning a database cannot be reached, added by the
+// database drivers that have their own
+var unreachableChecks = []func(err error) (bool) {}
+
+// Returns true if err means the database cannot be reached - a connection
+// refused or lost - rather than that an operation on it failed, e.g. on bad
+// data
+func databaseUnreachable(err error) (bool) {
+	var netErr net.Error
+
+	switch {
+		case errors.Is(err,driver.ErrBadConn), errors.Is(err,sql.ErrConnDone), errors.Is(err,io.EOF):
+			return true
+		case errors.Is(err,syscall.ECONNREFUSED), errors.Is(err,syscall.ECONNRESET), errors.Is(err,syscall.EPIPE):
+			return true
+		case errors.As(err,&netErr):
+			return true
+	}
+
+	for _, check := range unreachableChecks {
+		if check(err) { return true }
+	}
+	return false
+}
+
+// As boom(), for local servers' database errors; these panic instead, so a
+// ResilientServer can recover (see Resilient.go)
+func dbBoom(e error, msg string) {
+	if e != nil {
+		panic(&DatabaseError { msg: msg, err: e })
+	}
+}
+
+//
+// gzip helpers for stored raw payloads; nil passes through unchanged
+//
+
+func compress(data []byte) ([]byte, error) {
+	if data == nil { return nil, nil }
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil { return nil, err }
+	if err := zw.Close(); err != nil { return nil, err }
+
+	return buf.Bytes(), nil
+}
+
+// Errors are not wrapped, so a corrupt payload's io.EOF is not taken for a
+// lost connection (see databaseUnreachable())
+func decompress(data []byte) ([]byte, error) {
+	if data == nil { return nil, nil }
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil { return nil, fmt.Errorf("corrupt payload: %v",err) }
+	defer zr.Close()
+
+	body, err := io.ReadAll(zr)
+	if err != nil { return nil, fmt.Errorf("corrupt payload: %v",err) }
+	return body, nil
+}
+
+//
+// Fetches the body of a successful HTTP response, logging and returning nil
+// on any failure. what describes the upstream for the log.
+//
+
+func fetchBody(req *http.Request, what string) ([]byte) {
+	client := http.Client { Timeout: 30 * time.Second }
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Println("Unable to fetch "+what+" data: ",err)
+		return nil
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		log.Println("Non-200 return code from "+what+" server!")
+		log.Println("Status: ",resp.Status)
+		log.Println("Request: ",req.URL)
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Println("Unable to read "+what+" data: ",err)
+		return nil
+	}
+
+	return body
+}
+
 //
 // BarcodeServerInterface implementation using random data
 //
@@ -36,6 +148,7 @@ func (s *RandomServer) Lookup(barcode string) (*BarcodeItem) {
 		ISBN: fmt.Sprintf("ISBN%d",r),
 		Author: fmt.Sprintf("Author%d",r),
 		Title: fmt.Sprintf("Title%d",r),
+		Source: "random",
 	}
 }
 
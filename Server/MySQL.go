@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+//
+// MySQL dialect. Text columns can have no default, and full-text search uses
+// a FULLTEXT index in boolean mode.
+//
+
+type MySQLDialect struct {}
+
+func init() {
+	registerDialect("mysql", MySQLDialect {})
+
+	unreachableChecks = append(unreachableChecks, func(err error) (bool) {
+		return errors.Is(err,mysql.ErrInvalidConn)
+	})
+}
+
+// The driver takes neither URLs nor TLS files, so a mysql:// URL is converted
+// to its DSN, and the TLS settings registered with it. A URL can also give a
+// unix socket, as mysql://user:pass@/name?socket=/path/mysqld.sock, and any
+// other URL is taken to be a DSN already, e.g. user:pass@unix(/path)/name.
+func (MySQLDialect) Params(c DBConfig) (string, error) {
+	config := mysql.NewConfig()
+
+	switch {
+		case c.URL == "":
+			if c.Port == "" { c.Port = "3306" }
+			config.User, config.Passwd = c.User, c.Pass
+			config.Net, config.Addr = "tcp", c.Host+":"+c.Port
+			config.DBName = c.Name
+
+		case strings.HasPrefix(c.URL,"mysql://"):
+			u, err := url.Parse(c.URL)
+			if err != nil { return "", err }
+
+			config.User = u.User.Username()
+			config.Passwd, _ = u.User.Password()
+			config.DBName = strings.TrimPrefix(u.Path,"/")
+
+			q := u.Query()
+			if socket := q.Get("socket"); socket != "" {
+				config.Net, config.Addr = "unix", socket
+				q.Del("socket")
+			} else {
+				port := u.Port()
+				if port == "" { port = "3306" }
+				config.Net, config.Addr = "tcp", u.Hostname()+":"+port
+			}
+
+			// Other options are passed on, as in a DSN
+			if len(q) > 0 {
+				dsn, err := mysql.ParseDSN(config.FormatDSN()+"?"+q.Encode())
+				if err != nil { return "", err }
+				config = dsn
+			}
+
+		default:
+			dsn, err := mysql.ParseDSN(c.URL)
+			if err != nil { return "", err }
+			config = dsn
+	}
+
+	if c.UseTLS() {
+		tlsConfig, err := c.TLSConfig()
+		if err != nil { return "", err }
+		if err := mysql.RegisterTLSConfig("db_tls",tlsConfig); err != nil { return "", err }
+		config.TLSConfig = "db_tls"
+	}
+
+	return config.FormatDSN(), nil
+}
+
+// params = MySQL connection string
+func (MySQLDialect) Open(params string) (*sql.DB, error) {
+	return sql.Open("mysql",params)
+}
+
+// Writers can be concurrent, so reads and writes share a pool
+func (MySQLDialect) OpenReader(params string) (*sql.DB, error) { return nil, nil }
+
+func (MySQLDialect) Placeholder(n int) (string) { return "?" }
+func (MySQLDialect) IdentityType() (string) { return "int AUTO_INCREMENT" }
+func (MySQLDialect) BlobType() (string) { return "longblob" }
+func (MySQLDialect) BlobVar() (string) { return "?" }
+func (MySQLDialect) TextColumn() (string) { return "text NOT NULL" }
+func (MySQLDialect) Random() (string) { return "RAND()" }
+
+func (MySQLDialect) AlterToText(table string, column string) (string) {
+	return "ALTER TABLE "+table+" MODIFY "+column+" text NOT NULL;"
+}
+func (MySQLDialect) CurrentSchema() (string) { return "DATABASE()" }
+func (MySQLDialect) TextSearch() (string) { return "fulltext" }
+
+// || is logical OR in MySQL
+func (MySQLDialect) Concat(exprs ...string) (string) {
+	return "CONCAT("+strings.Join(exprs,",")+")"
+}
+
+func (MySQLDialect) Limit(offset bool) (string) {
+	if offset { return "LIMIT ? OFFSET ?" }
+	return "LIMIT ?"
+}
+
+func (MySQLDialect) Upsert(table string, key string, columns []string, policy string) (string) {
+	set := []string {}
+
+	// Assignments are made left to right, so fetched must come last
+	for _, c := range columns {
+		switch {
+			case policy == "skip": continue
+			case policy == "newest" && c == "fetched":
+				set = append(set,"fetched=GREATEST(fetched,VALUES(fetched))")
+			case policy == "newest":
+				set = append(set,fmt.Sprintf("%s=IF(VALUES(fetched)>fetched,VALUES(%s),%s)",c,c,c))
+			default:
+				set = append(set,fmt.Sprintf("%s=VALUES(%s)",c,c))
+		}
+	}
+	if len(set) == 0 { set = append(set,key+"="+key) } // no-op update
+
+	return "ON DUPLICATE KEY UPDATE "+strings.Join(set,",")
+}
+
+func (MySQLDialect) Retryable(err error) (bool) {
+	var myErr *mysql.MySQLError
+	if !errors.As(err,&myErr) { return false }
+	return myErr.Number == 1213 || myErr.Number == 1205
+}
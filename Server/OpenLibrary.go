@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//
+// BarcodeServerInterface implementation using the Open Library books API.
+// Only barcodes that are themselves ISBNs can be looked up.
+//
+
+type OpenLibraryServer struct {
+	api string // Base URL, e.g. https://openlibrary.org
+}
+
+// BarcodeItem.Source for items fetched from Open Library
+const openLibrarySource = "openlibrary"
+
+func init() {
+	extractors[openLibrarySource] = &OpenLibraryServer {}
+}
+
+// params = base URL of the API (empty = public Open Library server)
+func (s *OpenLibraryServer) Startup(params string) {
+	s.api = strings.TrimSuffix(params,"/")
+	if s.api == "" { s.api = "https://openlibrary.org" }
+}
+
+// Dummy function (included to satisfy BarcodeServerInterface)
+func (s *OpenLibraryServer) Shutdown() {}
+
+// Returns a BarcodeItem using Open Library, if the barcode is an ISBN
+func (s *OpenLibraryServer) Lookup(barcode string) (*BarcodeItem) {
+	isbn, ok := isbnFromBarcode(barcode)
+	if !ok { return nil }
+
+	URL := fmt.Sprintf("%s/api/books?bibkeys=%s&format=json&jscmd=data",
+		s.api, url.QueryEscape("ISBN:"+isbn))
+
+	req, err := http.NewRequest("GET",URL,nil)
+	boom(err,"Unable to create HTTP request")
+	req.Header.Set("Accept", "application/json")
+
+	body := fetchBody(req,"Open Library")
+	if body == nil { return nil }
+
+	result := s.Extract(barcode,body)
+	if result != nil { result.Raw = body }
+
+	return result
+}
+
+// Returns a BarcodeItem built from a raw Open Library books response
+func (s *OpenLibraryServer) Extract(barcode string, raw []byte) (*BarcodeItem) {
+	type name struct {
+		Name string `json:"name"`
+	}
+
+	type book struct {
+		Title string `json:"title"`
+		Authors []name `json:"authors"`
+		Identifiers struct {
+			ISBN10 []string `json:"isbn_10"`
+			ISBN13 []string `json:"isbn_13"`
+		} `json:"identifiers"`
+	}
+
+	// Response is keyed on the requested bibkey; an empty object = not found
+	var m map[string]book
+	if err := json.Unmarshal(raw,&m); err != nil {
+		log.Println("Unable to decode Open Library json data!")
+		return nil
+	}
+
+	for _, b := range m {
+		result := BarcodeItem { Barcode: barcode, Source: openLibrarySource, Title: b.Title }
+
+		authors := []string {}
+		for _, a := range b.Authors { authors = append(authors,a.Name) }
+		result.Author = strings.Join(authors,"; ")
+
+		isbns := append(b.Identifiers.ISBN13, b.Identifiers.ISBN10...)
+		if len(isbns) > 0 {
+			result.ISBN = isbns[0]
+		} else {
+			result.ISBN, _ = isbnFromBarcode(barcode)
+		}
+
+		return &result
+	}
+
+	return nil
+}
+
+// Dummy function (included to satisfy BarcodeServerInterface)
+func (s *OpenLibraryServer) Store(info *BarcodeItem) {
+	log.Println("Store called on read-only Open Library server!")
+}
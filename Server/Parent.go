@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// BarcodeServerInterface implementation that queries another BarcodeCache
+// server, so caches can be arranged in a tree with only the root going to
+// the external server. The parent is given either as a URL, or as the name
+// of a zeroconf service that is resolved on first use. Requests to the
+// parent carry the IDs of the servers that forwarded them, and a server
+// refuses a request it has already forwarded, so parents cannot loop.
+//
+
+type ParentServer struct {
+	service string // zeroconf service type & domain, for name lookups
+	domain string
+
+	name string // zeroconf service name; empty if a URL was given
+	base string // e.g. http://10.0.0.1:8080
+	mutex sync.Mutex
+}
+
+// params = parent URL, or zeroconf service name
+func (s *ParentServer) Startup(params string) {
+	s.name, s.base = "", ""
+
+	if strings.Contains(params,"://") {
+		s.base = strings.TrimSuffix(params,"/")
+	} else {
+		s.name = params
+	}
+
+	if s.service == "" { s.service = "_http._tcp" }
+	if s.domain == "" { s.domain = "local." }
+}
+
+// Dummy function (included to satisfy BarcodeServerInterface)
+func (s *ParentServer) Shutdown() {}
+
+// Upstreams that pass on the IDs of the servers a request was forwarded
+// by (oldest first), so a parent can tell when it comes back to it
+type ForwardingInterface interface {
+	LookupVia(barcode string, via []string) (*BarcodeItem)
+}
+
+// Looks a barcode up on a server, passing on the forwarding servers if it can
+func lookupVia(server BarcodeServerInterface, barcode string, via []string) (*BarcodeItem) {
+	if x, ok := server.(ForwardingInterface); ok { return x.LookupVia(barcode,via) }
+	return server.Lookup(barcode)
+}
+
+// Returns the parent's base URL, resolving the zeroconf name if needed
+func (s *ParentServer) baseURL() (string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.base == "" {
+		base, err := resolveService(s.name, s.service, s.domain, 5*time.Second)
+		if err != nil {
+			log.Println("Unable to locate parent server: ",err)
+			return ""
+		}
+		log.Println("Parent server '"+s.name+"' located at "+base)
+		s.base = base
+	}
+
+	return s.base
+}
+
+// Forget a resolved address, e.g. after the parent moved
+func (s *ParentServer) forget() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.name != "" { s.base = "" }
+}
+
+// Returns a BarcodeItem from the parent server, along with its raw payload
+func (s *ParentServer) Lookup(barcode string) (*BarcodeItem) { return s.LookupVia(barcode,nil) }
+
+// As Lookup, for a request forwarded by the given servers; we are added
+func (s *ParentServer) LookupVia(barcode string, via []string) (*BarcodeItem) {
+	base := s.baseURL()
+	if base == "" { return nil }
+
+	client := http.Client { Timeout: 30 * time.Second }
+
+	via = append(append([]string {}, via...), instanceID)
+	result, err := fetchFromCache(&client, base, barcode, false, via)
+	if err != nil {
+		log.Println("Unable to query parent server: ",err)
+		s.forget()
+	}
+
+	return result
+}
+
+// Header used to ask another BarcodeCache server to consult only its local
+// cache, and never its own upstreams; this prevents loops between peers.
+const scopeHeader = "X-BarcodeCache-Scope"
+
+// Header listing the IDs of the servers a request was forwarded by, from
+// child to parent
+const forwardedHeader = "X-BarcodeCache-Forwarded"
+
+// Returns the servers a request was forwarded by, if any
+func forwardedVia(r *http.Request) ([]string) {
+	via := []string {}
+	for _, id := range strings.Split(r.Header.Get(forwardedHeader),",") {
+		if id = strings.TrimSpace(id); id != "" { via = append(via,id) }
+	}
+	return via
+}
+
+// Returns a BarcodeItem, along with any raw payload, from the BarcodeCache
+// server at base; nil (and no error) if it was not found, or the server
+// refused the request as one it had already forwarded.
+func fetchFromCache(client *http.Client, base string, barcode string, localOnly bool, via []string) (*BarcodeItem, error) {
+	URL := fmt.Sprintf("%s/api/v1/barcode/%s", base, url.PathEscape(barcode))
+
+	get := func(URL string) (*http.Response, error) {
+		req, err := http.NewRequest("GET",URL,nil)
+		if err != nil { return nil, err }
+		if localOnly { req.Header.Set(scopeHeader,"local") }
+		if len(via) > 0 { req.Header.Set(forwardedHeader,strings.Join(via,",")) }
+		return client.Do(req)
+	}
+
+	resp, err := get(URL)
+	if err != nil { return nil, err }
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound { return nil, nil }
+	if resp.StatusCode == http.StatusLoopDetected {
+		log.Println("Server at "+base+" has already forwarded barcode \""+barcode+"\"")
+		return nil, nil
+	}
+	if resp.StatusCode != 200 { return nil, fmt.Errorf("status %s", resp.Status) }
+
+	// Older servers reply 200 with an empty body when nothing was found
+	result := BarcodeItem {}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || result.Barcode == "" {
+		return nil, nil
+	}
+
+	// Raw payload is optional; the server may not have one for this item
+	if raw, err := get(URL+"/raw"); err == nil {
+		if raw.StatusCode == 200 { result.Raw, _ = io.ReadAll(raw.Body) }
+		raw.Body.Close()
+	}
+
+	return &result, nil
+}
+
+// Dummy function (included to satisfy BarcodeServerInterface)
+func (s *ParentServer) Store(info *BarcodeItem) {
+	log.Println("Store called on read-only parent server!")
+}
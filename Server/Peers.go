@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+//
+// BarcodeServerInterface implementation that asks other BarcodeCache servers
+// on the local network (found by browsing zeroconf) for items in their local
+// caches. Peers are only ever asked for local results, so a miss on every
+// peer cannot bounce around the network.
+//
+
+// Zeroconf TXT entries identifying BarcodeCache servers
+const (
+	peerAppTXT = "app=BarcodeCache"
+	peerIDTXT = "id="
+)
+
+// Identifies this server process among its peers
+var instanceID = func() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}()
+
+// Zeroconf TXT entries to advertise, so peers can find (and skip) us
+func peerTXT() ([]string) {
+	return []string {peerAppTXT, peerIDTXT+instanceID}
+}
+
+type PeerServer struct {
+	service string // zeroconf service type & domain to browse
+	domain string
+	timeout time.Duration // per-lookup wait on peers
+
+	peers map[string]string // zeroconf instance name -> base URL
+	mutex sync.Mutex
+	stop context.CancelFunc
+}
+
+// Periodically browse for peers in the background
+func (s *PeerServer) Startup(_ string) {
+	s.Shutdown()
+
+	if s.service == "" { s.service = "_http._tcp" }
+	if s.domain == "" { s.domain = "local." }
+	if s.timeout <= 0 { s.timeout = 500 * time.Millisecond }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stop = cancel
+
+	go func() {
+		for {
+			s.browse(ctx, 5*time.Second)
+
+			select {
+				case <-ctx.Done(): return
+				case <-time.After(time.Minute):
+			}
+		}
+	}()
+}
+
+// Stops browsing for peers
+func (s *PeerServer) Shutdown() {
+	if s.stop != nil { s.stop() }
+	s.stop = nil
+}
+
+// Replaces the current peer list with those found within the wait time
+func (s *PeerServer) browse(parent context.Context, wait time.Duration) {
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		log.Println("Unable to browse for peers: ",err)
+		return
+	}
+
+	entries := make(chan *zeroconf.ServiceEntry)
+	ctx, cancel := context.WithTimeout(parent, wait)
+	defer drainEntries(entries)
+	defer cancel()
+
+	if err := resolver.Browse(ctx, s.service, s.domain, entries); err != nil {
+		log.Println("Unable to browse for peers: ",err)
+		return
+	}
+
+	found := map[string]string {}
+
+	for {
+		select {
+			case <-ctx.Done():
+				s.mutex.Lock()
+				s.peers = found
+				s.mutex.Unlock()
+				return
+
+			case e := <-entries:
+				isPeer, isSelf := false, false
+				for _, txt := range e.Text {
+					if txt == peerAppTXT { isPeer = true }
+					if txt == peerIDTXT+instanceID { isSelf = true }
+				}
+				if !isPeer || isSelf || len(e.AddrIPv4) < 1 { continue }
+
+				base := fmt.Sprintf("http://%s:%d", e.AddrIPv4[0], e.Port)
+				if _, ok := found[e.Instance]; !ok {
+					log.Println("Found peer '"+e.Instance+"' at "+base)
+				}
+				found[e.Instance] = base
+		}
+	}
+}
+
+// Asks every known peer for the item at once, returning the first result
+func (s *PeerServer) Lookup(barcode string) (*BarcodeItem) {
+	s.mutex.Lock()
+	bases := []string {}
+	for _, base := range s.peers { bases = append(bases,base) }
+	s.mutex.Unlock()
+
+	if len(bases) < 1 { return nil }
+
+	client := http.Client { Timeout: s.timeout }
+	results := make(chan *BarcodeItem, len(bases))
+
+	for _, base := range bases {
+		go func(base string) {
+			result, err := fetchFromCache(&client, base, barcode, true, nil)
+			if e, ok := err.(net.Error); err != nil && !(ok && e.Timeout()) {
+				log.Println("Unable to query peer at "+base+": ",err)
+			}
+			results <- result
+		}(base)
+	}
+
+	for range bases {
+		if result := <-results; result != nil { return result }
+	}
+
+	return nil
+}
+
+// Dummy function (included to satisfy BarcodeServerInterface)
+func (s *PeerServer) Store(info *BarcodeItem) {
+	log.Println("Store called on read-only peer server!")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+//
+// PostgreSQL dialect. Variables are numbered ($1, $2, ...), and full-text
+// search uses a GIN index of the search text's tsvector.
+//
+
+type PostgresDialect struct {}
+
+func init() {
+	registerDialect("postgres", PostgresDialect {})
+
+	// Connection exceptions, and the server shutting down or starting up
+	unreachableChecks = append(unreachableChecks, func(err error) (bool) {
+		var pqErr *pq.Error
+		if !errors.As(err,&pqErr) { return false }
+		return pqErr.Code.Class() == "08" || pqErr.Code == "57P01" || pqErr.Code == "57P02" || pqErr.Code == "57P03"
+	})
+}
+
+// lib/pq takes TLS settings as sslmode etc., and either a postgres:// URL or
+// keyword=value pairs; a host starting with '/' is a unix socket directory
+func (PostgresDialect) Params(c DBConfig) (string, error) {
+	tlsParams := [][2]string {
+		{"sslmode", c.TLS}, {"sslrootcert", c.TLSCA}, {"sslcert", c.TLSCert}, {"sslkey", c.TLSKey},
+	}
+
+	if c.URL != "" {
+		u, err := url.Parse(c.URL)
+		if err != nil { return "", err }
+		if u.Scheme != "postgres" && u.Scheme != "postgresql" { return "", fmt.Errorf("Not a postgres:// URL") }
+
+		q := u.Query()
+		for _, p := range tlsParams {
+			if p[1] != "" { q.Set(p[0],p[1]) }
+		}
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+
+	if c.Port == "" { c.Port = "5432" }
+	if c.TLS == "" { tlsParams[0][1] = "disable" }
+
+	// Values are quoted, in case of spaces
+	quote := func(v string) string {
+		return "'"+strings.NewReplacer(`\`,`\\`,`'`,`\'`).Replace(v)+"'"
+	}
+
+	params := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s",
+		quote(c.Host), quote(c.Port), quote(c.User), quote(c.Pass), quote(c.Name))
+	for _, p := range tlsParams {
+		if p[1] != "" { params += " "+p[0]+"="+quote(p[1]) }
+	}
+	return params, nil
+}
+
+// params = Postgres connection string
+func (PostgresDialect) Open(params string) (*sql.DB, error) {
+	return sql.Open("postgres",params)
+}
+
+// Writers can be concurrent, so reads and writes share a pool
+func (PostgresDialect) OpenReader(params string) (*sql.DB, error) { return nil, nil }
+
+func (PostgresDialect) Placeholder(n int) (string) { return fmt.Sprintf("$%d",n) }
+func (PostgresDialect) IdentityType() (string) { return "int GENERATED BY DEFAULT AS IDENTITY" }
+func (PostgresDialect) BlobType() (string) { return "bytea" }
+func (PostgresDialect) TextColumn() (string) { return "text NOT NULL DEFAULT ''" }
+func (PostgresDialect) Random() (string) { return "RANDOM()" }
+
+func (PostgresDialect) AlterToText(table string, column string) (string) {
+	return "ALTER TABLE "+table+" ALTER COLUMN "+column+" TYPE text;"
+}
+func (PostgresDialect) CurrentSchema() (string) { return "current_schema()" }
+func (PostgresDialect) TextSearch() (string) { return "tsvector" }
+
+// Postgres cannot always infer a bytea type for a bare variable, so we cast explicitly
+func (PostgresDialect) BlobVar() (string) { return "CAST(? AS bytea)" }
+
+func (PostgresDialect) Concat(exprs ...string) (string) {
+	return strings.Join(exprs,"||")
+}
+
+func (PostgresDialect) Limit(offset bool) (string) {
+	if offset { return "LIMIT ? OFFSET ?" }
+	return "LIMIT ?"
+}
+
+func (PostgresDialect) Upsert(table string, key string, columns []string, policy string) (string) {
+	return onConflict(table,key,columns,policy)
+}
+
+func (PostgresDialect) Retryable(err error) (bool) {
+	var pqErr *pq.Error
+	if !errors.As(err,&pqErr) { return false }
+	return pqErr.Code == "40001" || pqErr.Code == "40P01"
+}
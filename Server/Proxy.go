@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//
+// Generic HTTP response caching. Routes read from a config file map a local
+// path template onto an upstream URL template, e.g.
+//
+//   {"path": "proxy/bibs/{mms_id}",
+//    "url": "https://api-na.hosted.exlibrisgroup.com/almaws/v1/bibs/{mms_id}",
+//    "headers": {"Authorization": "apikey ${ALMA_KEY}"},
+//    "ttl": 86400}
+//
+// Paths are relative to the API prefix. Header values may refer to
+// environment variables, to keep keys out of the config file. The upstream
+// response body, status and content type are cached in the local server, for
+// successful (2xx) responses and any others the route lists, e.g.
+// "cache_statuses": [404]. 5xx and 429 responses count as failures.
+// Only the query parameters a route lists are passed upstream, e.g.
+// "query": ["view", "expand"], and only GET and HEAD requests are proxied.
+//
+
+// Proxy route, as read from the proxy config file
+type ProxyRoute struct {
+	Path string `json:"path"`
+	URL string `json:"url"`
+	Headers map[string]string `json:"headers"`
+	TTL int `json:"ttl"` // Seconds a cached response stays fresh (0 = forever)
+	Statuses []int `json:"cache_statuses"` // Cached besides 2xx
+	Query []string `json:"query"` // Query parameters passed upstream
+}
+
+// Largest upstream response body read
+const maxProxyBody = 16*1024*1024
+
+// Cached upstream response
+type CachedResponse struct {
+	Key string // Hash of URL
+	URL string
+	Status int
+	ContentType string
+	Body []byte
+	Fetched time.Time
+}
+
+// Reads proxy routes from a JSON file containing a list of ProxyRoute
+func loadProxyRoutes(filePath string, apiPrefix string) ([]ProxyRoute, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil { return nil, err }
+
+	routes := []ProxyRoute {}
+	if err := json.Unmarshal(data,&routes); err != nil { return nil, err }
+
+	for i := range routes {
+		routes[i].Path = strings.TrimPrefix(routes[i].Path,apiPrefix)
+		routes[i].Path = strings.TrimPrefix(routes[i].Path,"/")
+		if routes[i].Path == "" || routes[i].URL == "" {
+			return nil, fmt.Errorf("proxy route %d needs both a path and a url", i+1)
+		}
+	}
+
+	return routes, nil
+}
+
+// Returns the upstream URL for a request, filling in the route's template
+// and adding the query parameters it lists
+func (p *ProxyRoute) upstreamURL(r *http.Request) (string) {
+	pairs := []string {}
+	for k, v := range mux.Vars(r) {
+		pairs = append(pairs, "{"+k+"}", url.PathEscape(v))
+	}
+
+	URL := strings.NewReplacer(pairs...).Replace(p.URL)
+
+	// Encoded sorted, so the same parameters give the same cache key
+	query, params := url.Values {}, r.URL.Query()
+	for _, name := range p.Query {
+		if values, ok := params[name]; ok { query[name] = values }
+	}
+	if len(query) > 0 {
+		sep := "?"
+		if strings.Contains(URL,"?") { sep = "&" }
+		URL += sep+query.Encode()
+	}
+
+	return URL
+}
+
+// Returns true if responses with the status are cached
+func (p *ProxyRoute) cacheable(status int) (bool) {
+	if status >= 200 && status < 300 { return true }
+	for _, s := range p.Statuses {
+		if s == status { return true }
+	}
+	return false
+}
+
+// Fetches a response from upstream; failures are returned as errors
+func (p *ProxyRoute) fetch(URL string) (*CachedResponse, error) {
+	req, err := http.NewRequest("GET",URL,nil)
+	if err != nil { return nil, err }
+
+	for k, v := range p.Headers { req.Header.Set(k,os.ExpandEnv(v)) }
+
+	client := http.Client { Timeout: 30 * time.Second }
+	resp, err := client.Do(req)
+	if err != nil { return nil, err }
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body,maxProxyBody+1))
+	if err != nil { return nil, err }
+	if len(body) > maxProxyBody { return nil, fmt.Errorf("response over %d bytes", maxProxyBody) }
+
+	return &CachedResponse {
+		URL: URL,
+		Status: resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Body: body,
+		Fetched: time.Now(),
+	}, nil
+}
+
+//
+// Returns the response for a proxy route, from the local cache where fresh
+//
+
+func proxyHandler(w http.ResponseWriter, r *http.Request, route ProxyRoute, localServer BarcodeServerInterface) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	URL := route.upstreamURL(r)
+	log.Println(fmt.Sprintf("Incoming on %s : proxy \"%s\" (from %s)",r.URL.Path,URL,r.RemoteAddr))
+
+	cache, ok := localServer.(ResponseCacheInterface)
+	if !ok {
+		http.Error(w, "Response caching not supported by local server", http.StatusNotImplemented)
+		return
+	}
+
+	sum := sha256.Sum256([]byte(URL))
+	key := hex.EncodeToString(sum[:])
+
+	reply := func(resp *CachedResponse, status string) {
+		if resp.ContentType != "" { w.Header().Set("Content-Type", resp.ContentType) }
+		w.Header().Set("X-Cache", status)
+		w.WriteHeader(resp.Status)
+		w.Write(resp.Body)
+	}
+
+	cached := cache.LookupResponse(key)
+	if cached != nil {
+		age := time.Since(cached.Fetched)
+		if (route.TTL < 1) || (age < time.Duration(route.TTL)*time.Second) {
+			reply(cached,"HIT")
+			return
+		}
+	}
+
+	resp, err := route.fetch(URL)
+	if (err != nil) || (resp.Status >= 500) || (resp.Status == http.StatusTooManyRequests) {
+		if err == nil { err = fmt.Errorf("status %d", resp.Status) }
+		log.Println("Unable to fetch "+URL+": ",err)
+
+		// A stale response beats none at all
+		if cached != nil {
+			reply(cached,"STALE")
+		} else {
+			http.Error(w, "Upstream unavailable", http.StatusBadGateway)
+		}
+		return
+	}
+
+	if route.cacheable(resp.Status) {
+		resp.Key = key
+		cache.StoreResponse(resp)
+	}
+	reply(resp,"MISS")
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+//
+// Daily request quota, reset at local midnight. A limit of 0 = unlimited.
+// Quotas with a key keep the day's count in the quota file, if one is set,
+// so it survives restarts and is shared with other processes using the same
+// upstream (e.g. the warm command alongside the server); the file is locked
+// while a count is taken. Should the file fail, the count is kept in memory.
+//
+
+type Quota struct {
+	limit int
+	key string // Name the count is kept under in the quota file (empty = in memory)
+	used int
+	day string // YYYY-MM-DD the count applies to
+	mutex sync.Mutex
+}
+
+// Quota file, a bolt database with a bucket of counts for the day
+var quotaFile string
+
+// Resets the count if the day has changed; mutex must be held
+func (q *Quota) rollover() {
+	today := time.Now().Format("2006-01-02")
+	if q.day != today { q.day, q.used = today, 0 }
+}
+
+// Uses one request from the quota, returning false if none remain
+func (q *Quota) Take() (bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.rollover()
+	taken := false
+	take := func(used int) (int) {
+		if (q.limit > 0) && (used >= q.limit) { return used }
+		taken = true
+		return used+1
+	}
+
+	q.used = q.shared(take)
+	return taken
+}
+
+// Returns the requests used so far today, and the number remaining (-1 = unlimited)
+func (q *Quota) Usage() (int, int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.rollover()
+	q.used = q.shared(nil)
+	if q.limit < 1 { return q.used, -1 }
+	if q.used > q.limit { return q.used, 0 }
+	return q.used, q.limit-q.used
+}
+
+// Returns the day's count, after applying update to it (if not nil); the
+// count is read from the quota file, and written back, where there is one.
+// mutex must be held.
+func (q *Quota) shared(update func(used int) (int)) (int) {
+	if update == nil { update = func(used int) (int) { return used } }
+	if q.key == "" || quotaFile == "" { return update(q.used) }
+
+	used := q.used
+	err := func() (error) {
+		db, err := bolt.Open(quotaFile, 0644, &bolt.Options { Timeout: 5*time.Second })
+		if err != nil { return err }
+		defer db.Close()
+
+		return db.Update(func(tx *bolt.Tx) error {
+			// Earlier days' counts are dropped
+			old := [][]byte {}
+			tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+				if string(name) != q.day { old = append(old,append([]byte {},name...)) }
+				return nil
+			})
+			for _, name := range old {
+				if err := tx.DeleteBucket(name); err != nil { return err }
+			}
+
+			b, err := tx.CreateBucketIfNotExists([]byte(q.day))
+			if err != nil { return err }
+
+			stored := 0
+			if v := b.Get([]byte(q.key)); len(v) == 8 { stored = int(binary.BigEndian.Uint64(v)) }
+
+			used = update(stored)
+			if used == stored { return nil }
+
+			v := make([]byte,8)
+			binary.BigEndian.PutUint64(v,uint64(used))
+			return b.Put([]byte(q.key),v)
+		})
+	}()
+
+	if err != nil {
+		log.Println("Unable to use quota file "+quotaFile+"; counting in memory: ",err)
+		return update(q.used)
+	}
+	return used
+}
+
+//
+// BarcodeServerInterface wrapper that limits lookups on an upstream server
+// to a daily quota.
+//
+
+type QuotaServer struct {
+	server BarcodeServerInterface
+	quota *Quota
+	exceeded int // lookups refused since startup
+}
+
+// params = passed on to the wrapped server
+func (s *QuotaServer) Startup(params string) {
+	s.server.Startup(params)
+}
+
+// Shuts down the wrapped server
+func (s *QuotaServer) Shutdown() {
+	s.server.Shutdown()
+}
+
+// Returns a BarcodeItem from the wrapped server, if the quota allows
+func (s *QuotaServer) Lookup(barcode string) (*BarcodeItem) {
+	if !s.quota.Take() {
+		log.Println("Daily upstream quota exhausted; not looking up barcode \""+barcode+"\"")
+		s.quota.mutex.Lock()
+		s.exceeded++
+		s.quota.mutex.Unlock()
+		return nil
+	}
+	return s.server.Lookup(barcode)
+}
+
+// Returns the copy count from the wrapped server, if the quota allows
+func (s *QuotaServer) CountCopies(barcode string, raw []byte) (int, bool) {
+	x, ok := s.server.(CopyCounterInterface)
+	if !ok || !s.quota.Take() { return 0, false }
+	return x.CountCopies(barcode,raw)
+}
+
+// Returns true if the quota allows a further lookup today
+func (s *QuotaServer) QuotaLeft(barcode string) (bool) {
+	_, remaining := s.quota.Usage()
+	return remaining != 0
+}
+
+// Returns true if the wrapped server looks barcodes up in Alma
+func (s *QuotaServer) HasAlma() (bool) {
+	x, ok := s.server.(AlmaLookupInterface)
+	return ok && x.HasAlma()
+}
+
+// Returns a BarcodeItem from Alma via the wrapped server, if the quota allows
+func (s *QuotaServer) LookupAlma(barcode string) (*BarcodeItem, error) {
+	x, ok := s.server.(AlmaLookupInterface)
+	if !ok || !x.HasAlma() { return nil, errNoAlma }
+	if !s.quota.Take() {
+		s.quota.mutex.Lock()
+		s.exceeded++
+		s.quota.mutex.Unlock()
+		return nil, errQuotaExhausted
+	}
+	return x.LookupAlma(barcode)
+}
+
+// Dummy function (included to satisfy BarcodeServerInterface)
+func (s *QuotaServer) Store(info *BarcodeItem) {
+	log.Println("Store called on read-only quota server!")
+}
+
+// Returns the quota usage
+func (s *QuotaServer) Stats() (map[string]interface{}) {
+	used, remaining := s.quota.Usage()
+
+	s.quota.mutex.Lock()
+	defer s.quota.mutex.Unlock()
+
+	return map[string]interface{} {
+		"quota": map[string]interface{} {
+			"limit": s.quota.limit,
+			"used": used,
+			"remaining": remaining,
+			"refused": s.exceeded,
+		},
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+//
+// Redis storage, so several server instances can share one cache. Each item
+// is a hash, "[prefix]:item:[barcode]", optionally expiring; a sorted set
+// "[prefix]:barcodes" lists the barcodes (for listing, searching and
+// sampling, which scan the items; see KV.go), and sets "[prefix]:isbn:[isbn]"
+// index them by canonical ISBN-13. Writes that must be atomic across
+// instances, e.g. storing with a conflict policy, are Lua scripts.
+// Entries of expired items are removed from the set and index when met.
+//
+
+type RedisServer struct {
+	prefix string // of every key, e.g. "barcode_cache:barcodes"
+	conflict string // policy for items already stored (empty = newest)
+	ttl time.Duration // Expiry of items and responses (0 = never)
+	tls *tls.Config // used by rediss:// URLs (nil = default)
+	limits poolLimits
+	pool *redis.Pool
+}
+
+// Hash fields of an item, as stored by storeScript
+func (b *kvItem) fields() ([]interface{}) {
+	return []interface{} {
+		"barcode", b.Barcode, "isbn", b.ISBN, "author", b.Author, "title", b.Title,
+		"source", b.Source, "symbology", b.Symbology, "isbns", strings.Join(b.ISBNs,";"),
+		"search", b.Search, "raw", b.Raw, "fetched", b.Fetched,
+	}
+}
+
+// Returns the item stored in a hash, or nil if the hash is empty (absent)
+func kvItemFromHash(hash map[string]string) (*kvItem) {
+	if len(hash) == 0 { return nil }
+
+	b := kvItem {
+		Barcode: hash["barcode"], ISBN: hash["isbn"], Author: hash["author"], Title: hash["title"],
+		Source: hash["source"], Symbology: hash["symbology"], Search: hash["search"],
+	}
+	if isbns := hash["isbns"]; isbns != "" { b.ISBNs = strings.Split(isbns,";") }
+	if raw, ok := hash["raw"]; ok && raw != "" { b.Raw = []byte(raw) }
+	b.Fetched, _ = strconv.ParseInt(hash["fetched"],10,64)
+	b.Hits, _ = strconv.ParseInt(hash["hits"],10,64)
+	b.Accessed, _ = strconv.ParseInt(hash["accessed"],10,64)
+	return &b
+}
+
+var (
+	// Stores an item according to the policy: skip, overwrite, newest, or
+	// update (only if present). Keys: item, barcode set. Args: policy,
+	// fetched, TTL (seconds, 0 = none), ISBN key prefix, barcode, ISBNs
+	// (;-separated), then the hash fields and values. Returns 1 if written.
+	storeScript = redis.NewScript(2, `
+		local old = redis.call('HMGET', KEYS[1], 'fetched', 'isbns')
+		if old[1] then
+			if ARGV[1] == 'skip' then return 0 end
+			if ARGV[1] == 'newest' and tonumber(old[1]) >= tonumber(ARGV[2]) then return 0 end
+			for isbn in string.gmatch(old[2] or '', '[^;]+') do
+				redis.call('SREM', ARGV[4] .. isbn, ARGV[5])
+			end
+		elseif ARGV[1] == 'update' then
+			return 0
+		end
+		redis.call('HSET', KEYS[1], unpack(ARGV, 7))
+		for isbn in string.gmatch(ARGV[6], '[^;]+') do
+			redis.call('SADD', ARGV[4] .. isbn, ARGV[5])
+		end
+		redis.call('ZADD', KEYS[2], 0, ARGV[5])
+		if tonumber(ARGV[3]) > 0 then redis.call('EXPIRE', KEYS[1], ARGV[3]) end
+		return 1`)
+
+	// Changes a present item. Key: item. Args: field to increment (or ""),
+	// then fields and values to set. Returns 1 if changed.
+	touchScript = redis.NewScript(1, `
+		if redis.call('EXISTS', KEYS[1]) == 0 then return 0 end
+		if ARGV[1] ~= '' then redis.call('HINCRBY', KEYS[1], ARGV[1], 1) end
+		redis.call('HSET', KEYS[1], unpack(ARGV, 2))
+		return 1`)
+
+	// Removes an item. Keys: item, barcode set. Args: ISBN key prefix, barcode.
+	deleteScript = redis.NewScript(2, `
+		local isbns = redis.call('HGET', KEYS[1], 'isbns')
+		for isbn in string.gmatch(isbns or '', '[^;]+') do
+			redis.call('SREM', ARGV[1] .. isbn, ARGV[2])
+		end
+		redis.call('DEL', KEYS[1])
+		redis.call('ZREM', KEYS[2], ARGV[2])
+		return 1`)
+
+	// Forgets expired items. Key: barcode set or ISBN set. Args: ZREM or
+	// SREM, item key prefix, then the barcodes. Items stored again meanwhile
+	// (by another instance) are kept.
+	pruneScript = redis.NewScript(1, `
+		for i = 3, #ARGV do
+			if redis.call('EXISTS', ARGV[2] .. ARGV[i]) == 0 then
+				redis.call(ARGV[1], KEYS[1], ARGV[i])
+			end
+		end
+		return 1`)
+)
+
+func (s *RedisServer) itemKey(barcode string) (string) { return s.prefix+":item:"+barcode }
+func (s *RedisServer) barcodesKey() (string) { return s.prefix+":barcodes" }
+func (s *RedisServer) isbnKey(isbn string) (string) { return s.prefix+":isbn:"+isbn }
+func (s *RedisServer) responseKey(key string) (string) { return s.prefix+":response:"+key }
+
+// params = Redis URL, e.g. redis://:password@localhost:6379/0, or rediss://
+// for TLS
+func (s *RedisServer) Startup(params string) {
+	s.Shutdown()
+
+	options := []redis.DialOption {}
+	if s.tls != nil { options = append(options,redis.DialTLSConfig(s.tls)) }
+
+	s.pool = &redis.Pool {
+		MaxIdle: s.limits.maxIdle,
+		MaxActive: s.limits.maxOpen,
+		MaxConnLifetime: s.limits.lifetime,
+		Wait: true,
+		IdleTimeout: 5*time.Minute,
+		Dial: func() (redis.Conn, error) { return redis.DialURL(params,options...) },
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute { return nil }
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PING")
+	dbBoom(err, "Unable to connect to Redis")
+}
+
+// Closes the connection pool
+func (s *RedisServer) Shutdown() {
+	if s.pool != nil { s.pool.Close() }
+	s.pool = nil
+}
+
+// Stores an item according to policy; returns true if it was written
+func (s *RedisServer) store(conn redis.Conn, b *kvItem, policy string) (bool, error) {
+	// Updates leave the expiry as it is
+	ttl := int64(s.ttl/time.Second)
+	if policy == "update" { ttl = 0 }
+
+	args := []interface{} {s.itemKey(b.Barcode), s.barcodesKey(),
+		policy, b.Fetched, ttl, s.isbnKey(""), b.Barcode, strings.Join(b.ISBNs,";")}
+	if policy == "update" {
+		args = append(args, "isbn", b.ISBN, "author", b.Author, "title", b.Title,
+			"source", b.Source, "isbns", strings.Join(b.ISBNs,";"), "search", b.Search)
+	} else {
+		args = append(args,b.fields()...)
+	}
+
+	n, err := redis.Int(storeScript.Do(conn,args...))
+	return n == 1, err
+}
+
+// Returns the stored item for a barcode, or nil if absent
+func (s *RedisServer) get(conn redis.Conn, barcode string) (*kvItem, error) {
+	hash, err := redis.StringMap(conn.Do("HGETALL",s.itemKey(barcode)))
+	if err != nil { return nil, err }
+	return kvItemFromHash(hash), nil
+}
+
+// Returns the stored items for the barcodes, skipping (and forgetting)
+// those that have expired
+func (s *RedisServer) getAll(conn redis.Conn, barcodes []string) ([]*kvItem, error) {
+	const pageSize = 100
+	items := []*kvItem {}
+
+	for start := 0; start < len(barcodes); start += pageSize {
+		page := barcodes[start:]
+		if len(page) > pageSize { page = page[:pageSize] }
+
+		for _, barcode := range page {
+			if err := conn.Send("HGETALL",s.itemKey(barcode)); err != nil { return nil, err }
+		}
+		if err := conn.Flush(); err != nil { return nil, err }
+
+		expired := []interface{} {s.barcodesKey(),"ZREM",s.itemKey("")}
+		for _, barcode := range page {
+			hash, err := redis.StringMap(conn.Receive())
+			if err != nil { return nil, err }
+
+			if b := kvItemFromHash(hash); b != nil {
+				items = append(items,b)
+			} else {
+				expired = append(expired,barcode)
+			}
+		}
+
+		if len(expired) > 3 {
+			if _, err := pruneScript.Do(conn,expired...); err != nil { return nil, err }
+		}
+	}
+
+	return items, nil
+}
+
+// Returns every stored item, in barcode order
+func (s *RedisServer) all(conn redis.Conn) ([]*kvItem, error) {
+	barcodes, err := redis.Strings(conn.Do("ZRANGE",s.barcodesKey(),0,-1))
+	if err != nil { return nil, err }
+	return s.getAll(conn,barcodes)
+}
+
+// Returns a BarcodeItem from the database
+func (s *RedisServer) Lookup(barcode string) (*BarcodeItem) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	b, err := s.get(conn,barcode)
+	dbBoom(err, "Unable to lookup item")
+	if b == nil { return nil }
+	return b.item()
+}
+
+// Stores a BarcodeItem in the database, resolving conflicts by the policy
+func (s *RedisServer) Store(item *BarcodeItem) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	policy := s.conflict
+	if policy == "" { policy = "newest" }
+
+	b, err := newKVItem(item)
+	if err == nil { _, err = s.store(conn,b,policy) }
+	dbBoom(err, "Unable to store item")
+}
+
+// Overwrites the normalized fields of a BarcodeItem in the database
+func (s *RedisServer) Update(item *BarcodeItem) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	b, err := newKVItem(item)
+	if err == nil { _, err = s.store(conn,b,"update") }
+	dbBoom(err, "Unable to update item")
+}
+
+// Returns the raw upstream payload and its source for a barcode
+func (s *RedisServer) LookupRaw(barcode string) ([]byte, string) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	values, err := redis.ByteSlices(conn.Do("HMGET",s.itemKey(barcode),"source","raw"))
+	dbBoom(err, "Unable to lookup raw payload")
+	if len(values[1]) == 0 { return nil, "" }
+
+	raw, err := decompress(values[1])
+	dbBoom(err, "Unable to lookup raw payload")
+	return raw, string(values[0])
+}
+
+// Calls fn on every stored raw upstream payload. Barcodes are read a page at
+// a time, and no connection is held while fn is called.
+func (s *RedisServer) EachRaw(fn func(barcode, source string, raw []byte)) {
+	const pageSize = 100
+	after := "-"
+
+	for {
+		conn := s.pool.Get()
+		barcodes, err := redis.Strings(conn.Do("ZRANGEBYLEX",s.barcodesKey(),after,"+","LIMIT",0,pageSize))
+		var page []*kvItem
+		if err == nil { page, err = s.getAll(conn,barcodes) }
+		conn.Close()
+		dbBoom(err, "Unable to iterate raw payloads")
+
+		for _, b := range page {
+			if b.Raw == nil { continue }
+			raw, err := decompress(b.Raw)
+			dbBoom(err, "Unable to iterate raw payloads")
+			fn(b.Barcode,b.Source,raw)
+		}
+
+		if len(barcodes) < pageSize { return }
+		after = "("+barcodes[len(barcodes)-1]
+	}
+}
+
+// Returns every BarcodeItem in the database with the given ISBN-13
+func (s *RedisServer) LookupISBN(isbn string) ([]*BarcodeItem) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	barcodes, err := redis.Strings(conn.Do("SMEMBERS",s.isbnKey(isbn)))
+	dbBoom(err, "Unable to lookup ISBN")
+	sort.Strings(barcodes)
+
+	items := []*BarcodeItem {}
+	for _, barcode := range barcodes {
+		b, err := s.get(conn,barcode)
+		dbBoom(err, "Unable to lookup ISBN")
+
+		if b != nil {
+			items = append(items,b.item())
+		} else {
+			_, err := pruneScript.Do(conn,s.isbnKey(isbn),"SREM",s.itemKey(""),barcode)
+			dbBoom(err, "Unable to lookup ISBN")
+		}
+	}
+	return items
+}
+
+// Returns the BarcodeItems in the database matching the search terms
+func (s *RedisServer) Search(terms []string, limit, offset int) ([]*BarcodeItem) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	all, err := s.all(conn)
+	dbBoom(err, "Unable to search items")
+	return kvSearch(all,terms,limit,offset)
+}
+
+// Returns a page of BarcodeItems from the database
+func (s *RedisServer) List(q ListQuery) ([]*BarcodeItem) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	all, err := s.all(conn)
+	dbBoom(err, "Unable to list items")
+	return kvList(all,q)
+}
+
+// Stores a batch of BarcodeItems in the database, resolving conflicts by policy
+// Items are stored one by one, so those before a failure stay stored
+func (s *RedisServer) Import(items []*BarcodeItem, policy string) (ImportResult, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	result := ImportResult {}
+	for _, item := range items {
+		exists, err := redis.Bool(conn.Do("EXISTS",s.itemKey(item.Barcode)))
+		if err != nil { return result, err }
+
+		// Without a fetch time, an item cannot be newer
+		if exists && policy == "newest" && item.Fetched == nil {
+			result.Skipped++
+			continue
+		}
+
+		b, err := newKVItem(item)
+		if err != nil { return result, err }
+
+		written, err := s.store(conn,b,policy)
+		if err != nil { return result, err }
+
+		switch {
+			case !written: result.Skipped++
+			case exists: result.Updated++
+			default: result.Inserted++
+		}
+	}
+	return result, nil
+}
+
+// Counts a request served with the item
+func (s *RedisServer) RecordAccess(barcode string) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := touchScript.Do(conn,s.itemKey(barcode),"hits","accessed",time.Now().Unix())
+	dbBoom(err, "Unable to record access")
+}
+
+// Returns items from the database fetched before the given time
+func (s *RedisServer) Stale(order string, before time.Time, limit int) ([]*BarcodeItem) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	all, err := s.all(conn)
+	dbBoom(err, "Unable to find stale items")
+	return kvStale(all,order,before,limit)
+}
+
+// Replaces an item in the database with a fresh copy
+func (s *RedisServer) Refresh(item *BarcodeItem) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	b, err := newKVItem(item)
+	if err == nil { _, err = s.store(conn,b,"overwrite") }
+	dbBoom(err, "Unable to refresh item")
+}
+
+// Sets the time an item in the database was last checked upstream
+func (s *RedisServer) MarkFetched(barcode string, when time.Time) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := touchScript.Do(conn,s.itemKey(barcode),"","fetched",when.Unix())
+	dbBoom(err, "Unable to mark item fetched")
+}
+
+// Returns up to n items from the database, chosen at random
+func (s *RedisServer) Sample(n int) ([]*BarcodeItem) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	barcodes, err := redis.Strings(conn.Do("ZRANGE",s.barcodesKey(),0,-1))
+	dbBoom(err, "Unable to sample items")
+
+	rand.Shuffle(len(barcodes), func(i, j int) { barcodes[i], barcodes[j] = barcodes[j], barcodes[i] })
+	if len(barcodes) > n { barcodes = barcodes[:n] }
+
+	sample, err := s.getAll(conn,barcodes)
+	dbBoom(err, "Unable to sample items")
+	return kvItems(sample,0,n)
+}
+
+// Removes an item from the database
+func (s *RedisServer) Delete(barcode string) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := deleteScript.Do(conn,s.itemKey(barcode),s.barcodesKey(),s.isbnKey(""),barcode)
+	dbBoom(err, "Unable to delete item")
+}
+
+// Returns a cached HTTP response from the database
+func (s *RedisServer) LookupResponse(key string) (*CachedResponse) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	hash, err := redis.StringMap(conn.Do("HGETALL",s.responseKey(key)))
+	dbBoom(err, "Unable to lookup response")
+	if len(hash) == 0 { return nil }
+
+	body, err := decompress([]byte(hash["body"]))
+	dbBoom(err, "Unable to lookup response")
+
+	status, _ := strconv.Atoi(hash["status"])
+	fetched, _ := strconv.ParseInt(hash["fetched"],10,64)
+	return &CachedResponse {
+		Key: key, URL: hash["url"], Status: status, ContentType: hash["content_type"],
+		Body: body, Fetched: time.Unix(fetched,0),
+	}
+}
+
+// Stores a HTTP response in the database
+func (s *RedisServer) StoreResponse(resp *CachedResponse) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	body, err := compress(resp.Body)
+	dbBoom(err, "Unable to store response")
+
+	key := s.responseKey(resp.Key)
+	conn.Send("MULTI")
+	conn.Send("DEL",key)
+	conn.Send("HSET",key,"url",resp.URL,"status",resp.Status,"content_type",resp.ContentType,
+		"body",body,"fetched",resp.Fetched.Unix())
+	if s.ttl > 0 { conn.Send("EXPIRE",key,int64(s.ttl/time.Second)) }
+	_, err = conn.Do("EXEC")
+	dbBoom(err, "Unable to store response")
+}
+
+// Reports the number of items (including any expired but not yet noticed)
+func (s *RedisServer) Stats() (map[string]interface{}) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(conn.Do("ZCARD",s.barcodesKey()))
+	if err != nil {
+		log.Println("Unable to count items: ",err)
+		return map[string]interface{} {}
+	}
+	return map[string]interface{} {"items": n}
+}
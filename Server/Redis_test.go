@@ -0,0 +1,168 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+//
+// RedisServer against an in-process Redis stand-in, which runs the Lua
+// scripts and lets time be moved on for expiry
+//
+
+const testPrefix = "test:barcodes"
+
+// Returns a RedisServer using a new stand-in, shut down when the test ends
+func newTestRedis(t *testing.T, conflict string, ttl time.Duration) (*RedisServer, *miniredis.Miniredis) {
+	m := miniredis.RunT(t)
+
+	s := &RedisServer { prefix: testPrefix, conflict: conflict, ttl: ttl, limits: poolLimits { maxIdle: 2 } }
+
+	// Startup raises database errors, as for a ResilientServer to recover
+	err := (&ResilientServer {}).try(func() { s.Startup("redis://"+m.Addr()) })
+	if err != nil { t.Fatal(err) }
+	t.Cleanup(s.Shutdown)
+
+	return s, m
+}
+
+func testItem(barcode string, title string, isbn string, fetched time.Time) (*BarcodeItem) {
+	fetched = fetched.UTC().Truncate(time.Second)
+	return &BarcodeItem { Barcode: barcode, Title: title, ISBN: isbn, Author: "Author", Fetched: &fetched }
+}
+
+func TestRedisStorePolicies(t *testing.T) {
+	now := time.Now()
+	older, newer := now.Add(-time.Hour), now.Add(time.Hour)
+
+	tests := []struct {
+		policy string
+		afterOlder, afterNewer string // Titles after storing an older, then a newer copy
+	} {
+		{"newest", "first", "newer"},
+		{"skip", "first", "first"},
+		{"overwrite", "older", "newer"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			s, _ := newTestRedis(t, test.policy, 0)
+
+			s.Store(testItem("1001","first","",now))
+
+			s.Store(testItem("1001","older","",older))
+			if got := s.Lookup("1001"); got == nil || got.Title != test.afterOlder {
+				t.Fatalf("after older copy: got %+v, want title %q", got, test.afterOlder)
+			}
+
+			s.Store(testItem("1001","newer","",newer))
+			if got := s.Lookup("1001"); got == nil || got.Title != test.afterNewer {
+				t.Fatalf("after newer copy: got %+v, want title %q", got, test.afterNewer)
+			}
+		})
+	}
+}
+
+func TestRedisUpdateAndImport(t *testing.T) {
+	s, _ := newTestRedis(t, "newest", 0)
+	now := time.Now()
+
+	// Updates only change items already stored
+	s.Update(testItem("2001","updated","",now))
+	if got := s.Lookup("2001"); got != nil { t.Fatalf("update stored absent item: %+v", got) }
+
+	s.Store(testItem("2001","stored","",now))
+	s.Update(testItem("2001","updated","",now.Add(-time.Hour)))
+	if got := s.Lookup("2001"); got == nil || got.Title != "updated" { t.Fatalf("update not applied: %+v", got) }
+
+	// Without a fetch time, an imported copy cannot be newer
+	undated := &BarcodeItem { Barcode: "2001", Title: "undated" }
+	result, err := s.Import([]*BarcodeItem {undated, testItem("2002","new","",now)}, "newest")
+	if err != nil || result.Skipped != 1 || result.Inserted != 1 { t.Fatalf("import: got %+v, %v", result, err) }
+}
+
+func TestRedisISBNIndex(t *testing.T) {
+	s, m := newTestRedis(t, "overwrite", 0)
+	now := time.Now()
+
+	s.Store(testItem("3001","The Hobbit","0-261-10334-2 (pbk.)",now))
+	s.Store(testItem("3002","The Hobbit","9780261103344",now))
+
+	items := s.LookupISBN("9780261103344")
+	if len(items) != 2 || items[0].Barcode != "3001" || items[1].Barcode != "3002" {
+		t.Fatalf("lookup by ISBN: got %+v", items)
+	}
+
+	// A replaced copy leaves the index of its old ISBN
+	s.Store(testItem("3001","The Lord of the Rings","9780261102385",now))
+	if items := s.LookupISBN("9780261103344"); len(items) != 1 || items[0].Barcode != "3002" {
+		t.Fatalf("old ISBN after replacing: got %+v", items)
+	}
+	if items := s.LookupISBN("9780261102385"); len(items) != 1 || items[0].Barcode != "3001" {
+		t.Fatalf("new ISBN after replacing: got %+v", items)
+	}
+
+	s.Delete("3002")
+	if items := s.LookupISBN("9780261103344"); len(items) != 0 { t.Fatalf("ISBN after delete: got %+v", items) }
+	if m.Exists(s.isbnKey("9780261103344")) { t.Fatal("ISBN set left after delete") }
+	if members, _ := m.ZMembers(s.barcodesKey()); len(members) != 1 { t.Fatalf("barcodes after delete: %v", members) }
+}
+
+func TestRedisExpiry(t *testing.T) {
+	s, m := newTestRedis(t, "newest", time.Minute)
+	now := time.Now()
+
+	s.Store(testItem("4001","Expiring","9780261103344",now))
+	s.Store(testItem("4002","Also expiring","",now))
+	if ttl := m.TTL(s.itemKey("4001")); ttl != time.Minute { t.Fatalf("item TTL: got %v", ttl) }
+
+	m.FastForward(30*time.Second)
+	s.Store(testItem("4003","Stored later","",now))
+
+	m.FastForward(31*time.Second)
+	if got := s.Lookup("4001"); got != nil { t.Fatalf("expired item found: %+v", got) }
+
+	// Listing forgets the expired items, keeping the live one
+	items := s.List(ListQuery { Sort: "barcode", Limit: 10 })
+	if len(items) != 1 || items[0].Barcode != "4003" { t.Fatalf("list after expiry: got %+v", items) }
+	if members, _ := m.ZMembers(s.barcodesKey()); len(members) != 1 || members[0] != "4003" {
+		t.Fatalf("barcodes after pruning: %v", members)
+	}
+
+	// As does looking up an ISBN
+	if items := s.LookupISBN("9780261103344"); len(items) != 0 { t.Fatalf("ISBN after expiry: got %+v", items) }
+	if m.Exists(s.isbnKey("9780261103344")) { t.Fatal("ISBN set left after expiry") }
+}
+
+func TestRedisPruneKeepsStoredItems(t *testing.T) {
+	s, m := newTestRedis(t, "newest", 0)
+
+	s.Store(testItem("5001","Live","",time.Now()))
+	m.ZAdd(s.barcodesKey(), 0, "5002") // listed, but its item has gone
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := pruneScript.Do(conn,s.barcodesKey(),"ZREM",s.itemKey(""),"5001","5002")
+	if err != nil { t.Fatal(err) }
+
+	if members, _ := m.ZMembers(s.barcodesKey()); len(members) != 1 || members[0] != "5001" {
+		t.Fatalf("barcodes after pruning: %v", members)
+	}
+}
+
+func TestRedisResponses(t *testing.T) {
+	s, m := newTestRedis(t, "newest", time.Hour)
+
+	s.StoreResponse(&CachedResponse { Key: "k1", URL: "http://example.org/", Status: 200,
+		ContentType: "text/plain", Body: []byte("hello"), Fetched: time.Now() })
+
+	resp := s.LookupResponse("k1")
+	if resp == nil || string(resp.Body) != "hello" || resp.Status != 200 { t.Fatalf("response: got %+v", resp) }
+	if ttl := m.TTL(s.responseKey("k1")); ttl != time.Hour { t.Fatalf("response TTL: got %v", ttl) }
+
+	m.FastForward(time.Hour)
+	if resp := s.LookupResponse("k1"); resp != nil { t.Fatalf("expired response found: %+v", resp) }
+}
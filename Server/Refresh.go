@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Background refresh of cached items, as records change upstream (items
+// move, titles are corrected). Every interval, the stalest items - the
+// oldest, or the most requested among those older than a minimum age - are
+// fetched again, within a daily budget of upstream lookups taken from a share
+// of the tenant's quota. Items are looked up in Alma alone, as a parent or
+// peer may hold a copy as stale as ours. Changes are logged.
+//
+
+type Refresher struct {
+	name string // tenant, for the log
+	local RefreshInterface
+	remote AlmaLookupInterface
+
+	interval time.Duration
+	minAge time.Duration // Items fetched more recently are left alone
+	order string // "oldest" or "popular"
+	budget *Quota // Daily refresh lookups
+	perRun int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Returns a refresher for the servers, or an error if the local server
+// cannot refresh items (errNoAlma if there is no Alma upstream to refresh
+// them from). daily = refresh lookups per day.
+func newRefresher(name string, localServer BarcodeServerInterface, remoteServer BarcodeServerInterface, interval time.Duration, minAge time.Duration, order string, daily int) (*Refresher, error) {
+	local, ok := localServer.(RefreshInterface)
+	if !ok { return nil, fmt.Errorf("local server cannot refresh items") }
+
+	alma, ok := remoteServer.(AlmaLookupInterface)
+	if !ok || !alma.HasAlma() { return nil, errNoAlma }
+
+	switch order {
+		case "oldest", "popular":
+		default: return nil, fmt.Errorf("unknown refresh order '%s' (use oldest or popular)", order)
+	}
+	if interval <= 0 || daily < 1 { return nil, fmt.Errorf("refresh needs a positive interval and daily budget") }
+
+	// The daily budget is spread over the day's runs
+	runs := int(24*time.Hour / interval)
+	if runs < 1 { runs = 1 }
+	perRun := (daily + runs - 1) / runs
+
+	return &Refresher {
+		name: name,
+		local: local,
+		remote: alma,
+		interval: interval,
+		minAge: minAge,
+		order: order,
+		budget: &Quota { limit: daily },
+		perRun: perRun,
+	}, nil
+}
+
+// Starts refreshing in the background
+func (r *Refresher) Start() {
+	r.stop, r.done = make(chan struct{}), make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+				case <-ticker.C: r.run()
+				case <-r.stop: return
+			}
+		}
+	}()
+}
+
+// Stops refreshing, waiting for any run in progress
+func (r *Refresher) Stop() {
+	if r.stop == nil { return }
+	close(r.stop)
+	<-r.done
+	r.stop = nil
+}
+
+// Refreshes up to one run's share of the budget, stopping early if asked to
+func (r *Refresher) run() {
+	quotaCheck, hasQuota := r.remote.(QuotaCheckInterface)
+
+	items := r.local.Stale(r.order,time.Now().Add(-r.minAge),r.perRun)
+	checked, changed, missing, failed := 0, 0, 0, 0
+
+	for _, old := range items {
+		select {
+			case <-r.stop: return
+			default:
+		}
+
+		if hasQuota && !quotaCheck.QuotaLeft(old.Barcode) { break }
+		if !r.budget.Take() { break }
+
+		now := time.Now().UTC()
+
+		fresh, err := r.remote.LookupAlma(old.Barcode)
+		if err == errQuotaExhausted { break }
+
+		// Left to be tried again by a later run
+		if err != nil && err != errNotFound {
+			log.Println("Refresh ("+r.name+"): unable to look up barcode \""+old.Barcode+"\": ",err)
+			failed++
+			continue
+		}
+
+		checked++
+
+		if err == errNotFound {
+			// Keep the item, but check others before it again
+			log.Println("Refresh ("+r.name+"): barcode \""+old.Barcode+"\" no longer found upstream")
+			r.local.MarkFetched(old.Barcode,now)
+			missing++
+			continue
+		}
+
+		normalizeISBNs(fresh)
+		fresh.Symbology = barcodeSymbology(old.Barcode)
+		fresh.Fetched = &now
+
+		if diffs := diffItems(old,fresh); len(diffs) > 0 {
+			log.Println("Refresh ("+r.name+"): barcode \""+old.Barcode+"\" changed:",strings.Join(diffs,"; "))
+			changed++
+		}
+
+		r.local.Refresh(fresh)
+	}
+
+	if checked > 0 || failed > 0 {
+		_, remaining := r.budget.Usage()
+		log.Println(fmt.Sprintf("Refresh (%s): %d checked, %d changed, %d not found, %d failed; %d left in today's budget",
+			r.name, checked, changed, missing, failed, remaining))
+	}
+}
+
+//
+// Requests served with each item, counted so popular items can be refreshed
+// first. Accesses are recorded in the background, so replies never wait for
+// (or fail on) the database; if too many are waiting, further ones are not
+// counted.
+//
+
+type accessRecord struct {
+	server AccessRecorderInterface
+	barcode string
+}
+
+var accesses = struct {
+	queue chan accessRecord
+	done chan struct{}
+	once sync.Once
+} { queue: make(chan accessRecord, 1000), done: make(chan struct{}) }
+
+func init() {
+	go func() {
+		defer close(accesses.done)
+		for a := range accesses.queue { a.server.RecordAccess(a.barcode) }
+	}()
+}
+
+// Queues an access to an item, if the local server counts them
+func recordAccess(localServer BarcodeServerInterface, barcode string) {
+	x, ok := localServer.(AccessRecorderInterface)
+	if !ok { return }
+
+	select {
+		case accesses.queue <- accessRecord { server: x, barcode: barcode }:
+		default: log.Println("Too many accesses waiting; not counting barcode \""+barcode+"\"")
+	}
+}
+
+// Records the accesses waiting, before the local servers shut down
+func stopRecordingAccesses() {
+	accesses.once.Do(func() { close(accesses.queue) })
+	<-accesses.done
+}
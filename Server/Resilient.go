@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// BarcodeServerInterface wrapper that keeps a local server's database
+// failures from stopping the server. Connecting is retried with backoff at
+// startup; if the database is still unreachable, or fails later on, the
+// server runs degraded: lookups miss (so are answered from upstream), and
+// items stored are kept in a spool - in memory, and appended to a JSON Lines
+// file in the export format - while the database is reconnected in the
+// background. Once it is back, the spool is replayed into it. Local servers
+// raise database failures with dbBoom(), which this recovers from. Only a
+// database that cannot be reached (see databaseUnreachable()) is taken to be
+// down; other failures, e.g. on bad data, are logged and the call given up,
+// and spooled items failing so are moved to a file of rejected items.
+//
+
+type ResilientServer struct {
+	server BarcodeServerInterface
+	retries int // Connection attempts at startup
+	backoff time.Duration // Wait after the first failed attempt, doubled after each
+	degraded bool // Run degraded if the database fails, rather than exit
+	spoolPath string
+	spoolMax int // Items spooled at most
+
+	params string
+	mutex sync.RWMutex // Held for reading by calls on the server
+
+	state sync.Mutex // guards the fields below
+	down bool
+	spool map[string]*BarcodeItem // Items stored while down, by barcode
+	failures int
+	errors int // Calls failing other than on an unreachable database
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Longest wait between connection attempts
+const maxBackoff = time.Minute
+
+func nextBackoff(wait time.Duration) (time.Duration) {
+	if wait *= 2; wait > maxBackoff { wait = maxBackoff }
+	return wait
+}
+
+// Returns the database error recovered from a panic (nil if none), panicking
+// again on anything else
+func databaseError(r interface{}) (*DatabaseError) {
+	if r == nil { return nil }
+	if err, ok := r.(*DatabaseError); ok { return err }
+	panic(r)
+}
+
+// Calls fn, returning any database error it raises
+func (s *ResilientServer) try(fn func()) (err error) {
+	defer func() {
+		if dbErr := databaseError(recover()); dbErr != nil { err = dbErr }
+	}()
+	fn()
+	return nil
+}
+
+// params = passed on to the wrapped server. Items left in the spool by an
+// earlier run are replayed once the database is connected.
+func (s *ResilientServer) Startup(params string) {
+	s.params = params
+	s.spool = map[string]*BarcodeItem {}
+	if err := s.loadSpool(); err != nil { log.Println("Unable to read spool "+s.spoolPath+": ",err) }
+
+	wait := s.backoff
+	for attempt := 1; ; attempt++ {
+		err := s.try(func() { s.server.Startup(params) })
+		if err == nil { break }
+
+		if !databaseUnreachable(err) { log.Fatalln(err) }
+		if attempt >= s.retries {
+			s.fail(err)
+			return
+		}
+
+		log.Println(fmt.Sprintf("Database unavailable (attempt %d of %d), retrying in %v: %v",attempt,s.retries,wait,err))
+		time.Sleep(wait)
+		wait = nextBackoff(wait)
+	}
+
+	if len(s.spool) > 0 {
+		s.state.Lock()
+		s.down = true
+		s.state.Unlock()
+
+		if err := s.replay(); err != nil { s.fail(err) }
+	}
+}
+
+// Stops reconnecting, and shuts down the wrapped server
+func (s *ResilientServer) Shutdown() {
+	s.state.Lock()
+	stop, done := s.stop, s.done
+	s.stop = nil
+	s.state.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.server.Shutdown()
+}
+
+// Enters degraded mode after a database failure (or exits, if not allowed),
+// reconnecting in the background
+func (s *ResilientServer) fail(err error) {
+	if !s.degraded { log.Fatalln(err) }
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	s.failures++
+	if s.down && s.stop != nil { return }
+
+	log.Println("Database failed; running degraded until it recovers: ",err)
+	s.down = true
+	s.stop, s.done = make(chan struct{}), make(chan struct{})
+	go s.reconnect(s.stop,s.done)
+}
+
+// Restarts the wrapped server until it connects and the spool is replayed
+func (s *ResilientServer) reconnect(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	// Calls begun before the failure must finish before the server restarts
+	s.mutex.Lock()
+	s.mutex.Unlock()
+
+	wait := s.backoff
+	for {
+		select {
+			case <-time.After(wait):
+			case <-stop: return
+		}
+		wait = nextBackoff(wait)
+
+		if err := s.try(func() { s.server.Startup(s.params) }); err != nil {
+			log.Println(fmt.Sprintf("Database still unavailable, retrying in %v: %v",wait,err))
+			continue
+		}
+		if err := s.replay(); err != nil {
+			log.Println("Database failed while replaying spool: ",err)
+			continue
+		}
+
+		log.Println("Database recovered; no longer degraded")
+
+		// Unless it has already failed again, with a new reconnect
+		s.state.Lock()
+		if s.stop == stop { s.stop = nil }
+		s.state.Unlock()
+		return
+	}
+}
+
+// Stores the spooled items in the database, then leaves degraded mode
+func (s *ResilientServer) replay() (error) {
+	for {
+		s.state.Lock()
+		items := []*BarcodeItem {}
+		for _, item := range s.spool { items = append(items,item) }
+
+		// Nothing more can be spooled once down is cleared
+		if len(items) == 0 {
+			s.down = false
+			err := os.Remove(s.spoolPath)
+			s.state.Unlock()
+
+			if err != nil && !os.IsNotExist(err) { log.Println("Unable to remove spool "+s.spoolPath+": ",err) }
+			return nil
+		}
+		s.state.Unlock()
+
+		log.Println(fmt.Sprintf("Replaying %d spooled items ...",len(items)))
+
+		for _, item := range items {
+			if err := s.try(func() { s.server.Store(item) }); err != nil {
+				if databaseUnreachable(err) { return err }
+
+				// Trying again would fail the same way
+				log.Println("Unable to replay barcode \""+item.Barcode+"\"; moving it to "+s.rejectedPath()+": ",err)
+				if _, err := appendExportRecord(s.rejectedPath(),item); err != nil { log.Println("Unable to write "+s.rejectedPath()+": ",err) }
+			}
+
+			s.state.Lock()
+			if s.spool[item.Barcode] == item { delete(s.spool,item.Barcode) }
+			s.state.Unlock()
+		}
+	}
+}
+
+// Calls fn on the wrapped server, returning false if the database is down
+// (or fn finds it so). Other failures are logged, and fn given up.
+func (s *ResilientServer) use(fn func()) (ok bool) {
+	// Checked before waiting for the lock too, as reconnect() may be waiting
+	// for a call hung on the failed database
+	if s.Degraded() { return false }
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.Degraded() { return false }
+
+	err := s.try(fn)
+	if err == nil { return true }
+
+	if databaseUnreachable(err) {
+		s.fail(err)
+		return false
+	}
+
+	log.Println("Database error: ",err)
+	s.state.Lock()
+	s.errors++
+	s.state.Unlock()
+	return true
+}
+
+// Returns true while the database is down
+func (s *ResilientServer) Degraded() (bool) {
+	s.state.Lock()
+	defer s.state.Unlock()
+	return s.down
+}
+
+//
+// Spool of items stored while degraded
+//
+
+// Adds an item to the spool, returning false if the database is not down
+func (s *ResilientServer) spoolItem(item *BarcodeItem) (bool) {
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	if !s.down { return false }
+
+	if _, ok := s.spool[item.Barcode]; !ok && len(s.spool) >= s.spoolMax {
+		log.Println("Spool full; not caching barcode \""+item.Barcode+"\"")
+		return true
+	}
+	s.spool[item.Barcode] = item
+
+	// The file is only read back at startup, so later copies of an item
+	// simply replace earlier ones
+	if _, err := appendExportRecord(s.spoolPath,item); err != nil { log.Println("Unable to write spool "+s.spoolPath+": ",err) }
+	return true
+}
+
+// Returns a spooled item, if any
+func (s *ResilientServer) spooled(barcode string) (*BarcodeItem) {
+	s.state.Lock()
+	defer s.state.Unlock()
+	return s.spool[barcode]
+}
+
+// File of spooled items that could not be replayed
+func (s *ResilientServer) rejectedPath() (string) {
+	return strings.TrimSuffix(s.spoolPath,".jsonl")+".rejected.jsonl"
+}
+
+// Appends an item to a JSON Lines file in the export format, and syncs it to
+// disk, returning the offset of its line
+func appendExportRecord(path string, item *BarcodeItem) (offset int64, err error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil { return 0, err }
+
+	offset, err = file.Seek(0,io.SeekEnd)
+	if err == nil { err = json.NewEncoder(file).Encode(&exportRecord { BarcodeItem: item, Raw: item.Raw }) }
+	if err == nil { err = file.Sync() }
+	if closeErr := file.Close(); err == nil { err = closeErr }
+	return offset, err
+}
+
+func (s *ResilientServer) loadSpool() (error) {
+	file, err := os.Open(s.spoolPath)
+	if os.IsNotExist(err) { return nil }
+	if err != nil { return err }
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte,64*1024),16*1024*1024)
+
+	for scanner.Scan() {
+		record := exportRecord {}
+		if err := json.Unmarshal(scanner.Bytes(),&record); err != nil || record.BarcodeItem == nil { continue }
+
+		item := *record.BarcodeItem
+		item.Raw = record.Raw
+		s.spool[item.Barcode] = &item
+	}
+	if len(s.spool) > 0 { log.Println(fmt.Sprintf("Found %d items spooled by an earlier run",len(s.spool))) }
+
+	return scanner.Err()
+}
+
+//
+// Calls passed on to the wrapped server
+//
+
+// Returns a BarcodeItem from the wrapped server, or the spool while degraded
+func (s *ResilientServer) Lookup(barcode string) (result *BarcodeItem) {
+	if s.use(func() { result = s.server.Lookup(barcode) }) { return result }
+	return s.spooled(barcode)
+}
+
+// Stores a BarcodeItem in the wrapped server, or the spool while degraded
+func (s *ResilientServer) Store(item *BarcodeItem) {
+	for !s.use(func() { s.server.Store(item) }) {
+		if s.spoolItem(item) { return }
+	}
+}
+
+func (s *ResilientServer) Update(item *BarcodeItem) {
+	if x, ok := s.server.(RawStoreInterface); ok { s.use(func() { x.Update(item) }) }
+}
+
+func (s *ResilientServer) LookupRaw(barcode string) (raw []byte, source string) {
+	x, ok := s.server.(RawStoreInterface)
+	if ok && s.use(func() { raw, source = x.LookupRaw(barcode) }) { return raw, source }
+
+	if item := s.spooled(barcode); item != nil { return item.Raw, item.Source }
+	return nil, ""
+}
+
+func (s *ResilientServer) EachRaw(fn func(barcode, source string, raw []byte)) {
+	if x, ok := s.server.(RawStoreInterface); ok { s.use(func() { x.EachRaw(fn) }) }
+}
+
+func (s *ResilientServer) LookupISBN(isbn string) (items []*BarcodeItem) {
+	if x, ok := s.server.(ISBNIndexInterface); ok && s.use(func() { items = x.LookupISBN(isbn) }) { return items }
+	return []*BarcodeItem {}
+}
+
+func (s *ResilientServer) Search(terms []string, limit, offset int) (items []*BarcodeItem) {
+	if x, ok := s.server.(SearchInterface); ok && s.use(func() { items = x.Search(terms,limit,offset) }) { return items }
+	return []*BarcodeItem {}
+}
+
+func (s *ResilientServer) List(query ListQuery) (items []*BarcodeItem) {
+	if x, ok := s.server.(ListInterface); ok && s.use(func() { items = x.List(query) }) { return items }
+	return []*BarcodeItem {}
+}
+
+// Items imported while degraded are rejected rather than spooled, as the
+// import policy could not be applied. Errors are raised within use(), so an
+// unreachable database is noticed, then returned.
+func (s *ResilientServer) Import(items []*BarcodeItem, policy string) (result ImportResult, err error) {
+	x, ok := s.server.(ImportInterface)
+	if ok && s.use(func() { result, err = x.Import(items,policy); dbBoom(err, "Unable to import items") }) { return result, err }
+
+	log.Println(fmt.Sprintf("Database unavailable; rejected %d imported items",len(items)))
+	return ImportResult { Rejected: len(items) }, nil
+}
+
+func (s *ResilientServer) RecordAccess(barcode string) {
+	if x, ok := s.server.(AccessRecorderInterface); ok { s.use(func() { x.RecordAccess(barcode) }) }
+}
+
+func (s *ResilientServer) Stale(order string, before time.Time, limit int) (items []*BarcodeItem) {
+	if x, ok := s.server.(RefreshInterface); ok && s.use(func() { items = x.Stale(order,before,limit) }) { return items }
+	return []*BarcodeItem {}
+}
+
+// Refreshed items are spooled while degraded, as for Store()
+func (s *ResilientServer) Refresh(item *BarcodeItem) {
+	x, ok := s.server.(RefreshInterface)
+	if !ok { return }
+
+	for !s.use(func() { x.Refresh(item) }) {
+		if s.spoolItem(item) { return }
+	}
+}
+
+func (s *ResilientServer) MarkFetched(barcode string, when time.Time) {
+	if x, ok := s.server.(RefreshInterface); ok { s.use(func() { x.MarkFetched(barcode,when) }) }
+}
+
+func (s *ResilientServer) Sample(n int) (items []*BarcodeItem) {
+	if x, ok := s.server.(AuditInterface); ok && s.use(func() { items = x.Sample(n) }) { return items }
+	return []*BarcodeItem {}
+}
+
+func (s *ResilientServer) Delete(barcode string) {
+	if x, ok := s.server.(AuditInterface); ok { s.use(func() { x.Delete(barcode) }) }
+}
+
+func (s *ResilientServer) LookupResponse(key string) (resp *CachedResponse) {
+	if x, ok := s.server.(ResponseCacheInterface); ok { s.use(func() { resp = x.LookupResponse(key) }) }
+	return resp
+}
+
+func (s *ResilientServer) StoreResponse(resp *CachedResponse) {
+	if x, ok := s.server.(ResponseCacheInterface); ok { s.use(func() { x.StoreResponse(resp) }) }
+}
+
+// Returns the wrapped server's statistics, if any, and the database state
+func (s *ResilientServer) Stats() (map[string]interface{}) {
+	stats := map[string]interface{} {}
+	if x, ok := s.server.(StatsInterface); ok { s.use(func() { stats = x.Stats() }) }
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	stats["database"] = map[string]interface{} {
+		"degraded": s.down,
+		"spooled": len(s.spool),
+		"failures": s.failures,
+		"errors": s.errors,
+	}
+	return stats
+}
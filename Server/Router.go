@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+//
+// BarcodeServerInterface implementation that routes each barcode to one of
+// several upstream servers according to its prefix or a regular expression,
+// e.g. so one server can cover several institutions with their own Alma
+// instances and keys. Barcodes matching no route go to the default server.
+//
+
+// Routing rule, as read from the routes file
+type RouteConfig struct {
+	Name string `json:"name"`
+	Prefix string `json:"prefix"` // Either a barcode prefix ...
+	Regex string `json:"regex"` // ... or a regular expression
+	Upstream string `json:"upstream"` // e.g. "alma"; see newUpstream()
+	URL string `json:"url"`
+	Key string `json:"key"`
+	Quota int `json:"quota"` // Daily lookups (0 = unlimited)
+}
+
+type route struct {
+	name string
+	prefix string
+	regex *regexp.Regexp
+	server BarcodeServerInterface
+	quota *Quota
+
+	requests, found int
+}
+
+type RouterServer struct {
+	routes []*route // Evaluated in order; last is the default route
+	mutex sync.Mutex
+}
+
+// Reads routing rules from a JSON file containing a list of RouteConfig
+func loadRoutes(filePath string) ([]RouteConfig, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil { return nil, err }
+
+	configs := []RouteConfig {}
+	err = json.Unmarshal(data,&configs)
+	return configs, err
+}
+
+// Creates a router from the rules, with the default server used for unrouted barcodes
+func newRouterServer(configs []RouteConfig, defaultServer BarcodeServerInterface, defaultQuota *Quota) (*RouterServer, error) {
+	s := &RouterServer {}
+
+	for i, config := range configs {
+		r := &route { name: config.Name, prefix: config.Prefix }
+		if r.name == "" { r.name = fmt.Sprintf("route%d",i+1) }
+
+		if config.Regex != "" {
+			re, err := regexp.Compile(config.Regex)
+			if err != nil { return nil, fmt.Errorf("route '%s': %v", r.name, err) }
+			r.regex = re
+		} else if config.Prefix == "" {
+			return nil, fmt.Errorf("route '%s' has neither prefix nor regex", r.name)
+		}
+
+		upstream, err := newUpstream(config.Upstream, config.URL, config.Key)
+		if err != nil { return nil, fmt.Errorf("route '%s': %v", r.name, err) }
+
+		r.quota = &Quota { limit: config.Quota }
+		if defaultQuota != nil && defaultQuota.key != "" { r.quota.key = defaultQuota.key+"/"+r.name }
+		r.server = &QuotaServer { server: upstream, quota: r.quota }
+
+		log.Println(fmt.Sprintf("Route '%s': prefix \"%s\", regex \"%s\" -> %s", r.name, config.Prefix, config.Regex, config.Upstream))
+		s.routes = append(s.routes,r)
+	}
+
+	s.routes = append(s.routes, &route { name: "default", server: defaultServer, quota: defaultQuota })
+
+	return s, nil
+}
+
+// Dummy function (included to satisfy BarcodeServerInterface)
+func (s *RouterServer) Startup(_ string) {}
+
+// Shuts down the upstream server of every route
+func (s *RouterServer) Shutdown() {
+	for _, r := range s.routes { r.server.Shutdown() }
+}
+
+// Returns the route for a barcode
+func (s *RouterServer) match(barcode string) (*route) {
+	for _, r := range s.routes {
+		if r.regex != nil {
+			if r.regex.MatchString(barcode) { return r }
+		} else if (r.prefix != "") && strings.HasPrefix(barcode,r.prefix) {
+			return r
+		}
+	}
+	return s.routes[len(s.routes)-1]
+}
+
+// Returns a BarcodeItem from the upstream server the barcode is routed to
+func (s *RouterServer) Lookup(barcode string) (*BarcodeItem) { return s.LookupVia(barcode,nil) }
+
+// As Lookup, for a request forwarded by the given servers
+func (s *RouterServer) LookupVia(barcode string, via []string) (*BarcodeItem) {
+	r := s.match(barcode)
+	result := lookupVia(r.server,barcode,via)
+
+	s.mutex.Lock()
+	r.requests++
+	if result != nil { r.found++ }
+	s.mutex.Unlock()
+
+	return result
+}
+
+// Returns the copy count from the upstream server the barcode is routed to
+func (s *RouterServer) CountCopies(barcode string, raw []byte) (int, bool) {
+	x, ok := s.match(barcode).server.(CopyCounterInterface)
+	if !ok { return 0, false }
+	return x.CountCopies(barcode,raw)
+}
+
+// Returns true if the quota of the barcode's route allows a further lookup today
+func (s *RouterServer) QuotaLeft(barcode string) (bool) {
+	x, ok := s.match(barcode).server.(QuotaCheckInterface)
+	return !ok || x.QuotaLeft(barcode)
+}
+
+// Returns true if any route looks barcodes up in Alma
+func (s *RouterServer) HasAlma() (bool) {
+	for _, r := range s.routes {
+		if x, ok := r.server.(AlmaLookupInterface); ok && x.HasAlma() { return true }
+	}
+	return false
+}
+
+// Returns a BarcodeItem from Alma via the route for the barcode
+func (s *RouterServer) LookupAlma(barcode string) (*BarcodeItem, error) {
+	x, ok := s.match(barcode).server.(AlmaLookupInterface)
+	if !ok { return nil, errNoAlma }
+	return x.LookupAlma(barcode)
+}
+
+// Dummy function (included to satisfy BarcodeServerInterface)
+func (s *RouterServer) Store(info *BarcodeItem) {
+	log.Println("Store called on read-only router server!")
+}
+
+// Returns request counts and quota usage for each route
+func (s *RouterServer) Stats() (map[string]interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	routes := map[string]interface{} {}
+	for _, r := range s.routes {
+		stats := map[string]interface{} {
+			"requests": r.requests,
+			"found": r.found,
+			"not_found": r.requests-r.found,
+		}
+		if r.quota != nil {
+			used, remaining := r.quota.Usage()
+			stats["quota_limit"] = r.quota.limit
+			stats["quota_used"] = used
+			stats["quota_remaining"] = remaining
+		}
+		routes[r.name] = stats
+	}
+
+	return map[string]interface{} { "routes": routes }
+}
@@ -4,12 +4,9 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
-	"os"
+	"strconv"
 	"strings"
-
-	_ "github.com/go-sql-driver/mysql"
-	_ "github.com/lib/pq"
-	_ "github.com/mattn/go-sqlite3"
+	"time"
 )
 
 // Simple translation layer to allow some common vanilla SQL
@@ -22,292 +19,1233 @@ import (
 // - Oracle : ':varname'
 //
 // We therefore store a set of customised SQL procedure strings,
-// transformed according to the specific database we're using.
+// transformed according to the specific database we're using (its
+// Dialect; see Dialect.go).
 //
 // Implementation is (and should be) opaque, so lower-case members.
 
 type SQLShim struct {
-	setup string
+	dialect Dialect
+	table string
+	setup []string
 	lookup string
-	insert string
+	upsertSkip string // insert, by conflict policy
+	upsertOverwrite string
+	upsertNewest string
+	conflict string // policy for Store(): "skip", "overwrite" or "newest"
+	update string
+	lookupRaw string
+	pageRaw string
+	pageISBNs string
+	updateISBNs string
+	pageSymbologies string
+	updateSymbology string
+	deleteISBNs string
+	insertISBN string
+	lookupISBN string
+	countISBNs string
+	pageISBNIndex string
+	lookupResponse string
+	upsertResponse string
+	listItems string // completed by List()
+	lookupFetched string
+	recordAccess string
+	markFetched string
+	staleOldest string
+	stalePopular string
+	sample string
+	deleteItem string
+	pageSearch string
+	updateSearch string
+	textSearch string // "fts5", "like", "tsvector" or "fulltext"
+	search string
+	searchLike string // LIKE matching, completed by searchArgs()
+	searchIndex string
+	deleteFTS string
+	insertFTS string
+	checkFTS string
+	clearFTS string
+	pageFTS string
+	columns []sqlColumn
+	limits poolLimits
+	batch int // most writes per transaction, for a single writer
+	likeSearch bool // SQLite builds lacking FTS5 may search with LIKE, rather than fail
 	db *sql.DB
+	reader *sql.DB // pool for reads; the same as db, unless there is a single writer
+	writes chan sqlWrite // to the single writer, if any
+	writerDone chan struct{}
 }
 
-// Initialises stored SQL procedures for the specified database type
-func (s *SQLShim) InitProcedures(dbType string) (error) {
-	if dbType == "" { log.Fatalln("Database type is empty!") }
+// Column added after the original schema, with an optional function to
+// fill it in for existing rows
+type sqlColumn struct {
+	name string
+	definition string
+	backfill func() error
+}
+
+// Columns replaced when an item or response is stored over an existing one
+var (
+	itemColumns = []string {"isbn", "author", "title", "source", "raw", "isbns", "symbology", "search", "fetched"}
+	responseColumns = []string {"url", "status", "content_type", "body", "fetched"}
+)
+
+// Write queued for the single writer, which sends its result to done
+type sqlWrite struct {
+	fn func(tx *sql.Tx) error
+	done chan error
+}
+
+// Runs fn in a transaction, committing it if fn succeeds. The transaction is
+// tried again, a few times, if it fails because of concurrent writers.
+func (s *SQLShim) inTx(fn func(tx *sql.Tx) error) (error) {
+	const attempts = 4
+	var err error
+
+	for i := 0; i < attempts; i++ {
+		if i > 0 { time.Sleep(time.Duration(i*i) * 50 * time.Millisecond) }
+
+		var tx *sql.Tx
+		if tx, err = s.db.Begin(); err == nil {
+			if err = fn(tx); err == nil {
+				err = tx.Commit()
+			} else {
+				tx.Rollback()
+			}
+		}
+
+		if err == nil || !s.dialect.Retryable(err) { return err }
+	}
+
+	return err
+}
+
+// Runs fn in a transaction, as for inTx(). Where there is a single writer,
+// fn is queued for it, and may share a transaction with other writes; fn
+// can then be run more than once, so should not depend on earlier runs.
+func (s *SQLShim) write(fn func(tx *sql.Tx) error) (error) {
+	if s.writes == nil { return s.inTx(fn) }
+
+	w := sqlWrite { fn: fn, done: make(chan error, 1) }
+	s.writes <- w
+	return <-w.done
+}
+
+// Makes the queued writes until the queue is closed: each transaction takes
+// as many as are waiting, up to the batch size, so concurrent stores cost a
+// single commit
+func (s *SQLShim) writer(writes chan sqlWrite, done chan struct{}) {
+	defer close(done)
+
+	batchMax := s.batch
+	if batchMax < 1 { batchMax = 1 }
+
+	for w := range writes {
+		batch := []sqlWrite {w}
+
+		waiting:
+		for len(batch) < batchMax {
+			select {
+				case w, ok := <-writes:
+					if !ok { break waiting }
+					batch = append(batch,w)
+				default:
+					break waiting
+			}
+		}
+
+		err := s.inTx(func(tx *sql.Tx) error {
+			for _, w := range batch {
+				if err := w.fn(tx); err != nil { return err }
+			}
+			return nil
+		})
+
+		// One failed write fails the batch, so the writes are tried again alone
+		if err != nil && len(batch) > 1 {
+			for _, w := range batch { w.done <- s.inTx(w.fn) }
+			continue
+		}
+		for _, w := range batch { w.done <- err }
+	}
+}
+
+// Stops any single writer, once it has made the queued writes, and closes
+// the database
+func (s *SQLShim) Close() {
+	if s.writes != nil {
+		close(s.writes)
+		<-s.writerDone
+		s.writes = nil
+	}
+
+	if s.reader != nil && s.reader != s.db { s.reader.Close() }
+	if s.db != nil { s.db.Close() }
+	s.db, s.reader = nil, nil
+}
+
+// Initialises stored SQL procedures for the database dialect, using the
+// named table (empty = "barcodes") so several caches can share a database
+func (s *SQLShim) InitProcedures(dialect Dialect, table string) (error) {
+	if dialect == nil { log.Fatalln("Database dialect is nil!") }
+	if table == "" { table = "barcodes" }
 
 	//
-	// Primary keys:
-	// - MySql   : id int AUTO_INCREMENT PRIMARY KEY
-	// - Postgres: id int GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY
-	// - SQLite  : id integer PRIMARY KEY
-	// - Oracle  : (as Postgres)
-	//
-	// Select/Insert variables:
-	// - MySql   : "?
-	// - Postgres: "$N"
-	// - SQLite  : Either "?" or "$N"
-	// - Oracle  : ":name"
+	// Dialect-specific types and expressions are filled in with fmt, and
+	// paging clauses at {limit} and {limit_offset}; variables are '?', and
+	// rewritten for the dialect.
 	//
 	// Note: MySQL cannot use "text" as an unique index, as the length is
 	// unbounded; we therefore use varchar() for barcode column.
 	//
 
 	const (
-		rawSetup = `CREATE TABLE IF NOT EXISTS barcodes(
+		rawSetup = `CREATE TABLE IF NOT EXISTS {table}(
 		id      %s          PRIMARY KEY,
 		barcode varchar(50) NOT NULL UNIQUE,
 		isbn    text        NOT NULL,
 		author  text        NOT NULL,
-		title   text        NOT NULL);`	
+		title   text        NOT NULL,
+		source  varchar(50) NOT NULL DEFAULT '',
+		raw     %s,
+		isbns   text        NOT NULL,
+		symbology varchar(20) NOT NULL DEFAULT '',
+		search  text        NOT NULL,
+		fetched bigint      NOT NULL DEFAULT 0,
+		hits    bigint      NOT NULL DEFAULT 0,
+		accessed bigint     NOT NULL DEFAULT 0);`
+
+		rawLookup = "SELECT barcode,isbn,author,title,source,isbns,symbology,fetched FROM {table} WHERE barcode=(?);"
+
+		// Items already present are handled by the conflict clause, per
+		// dialect and policy; see upsertClause()
+		rawUpsert = `INSERT INTO {table}(barcode,isbn,author,title,source,raw,isbns,symbology,search,fetched)
+		VALUES (?,?,?,?,?,%s,?,?,?,?) %s;`
+
+		rawUpdate = "UPDATE {table} SET isbn=?,author=?,title=?,source=?,isbns=?,search=? WHERE barcode=(?);"
+
+		rawLookupFetched = "SELECT fetched FROM {table} WHERE barcode=(?);"
 
-		rawLookup = "SELECT isbn,author,title FROM barcodes WHERE barcode=(?);"
+		// Access counts, and entries due a refresh from upstream
+		rawRecordAccess = "UPDATE {table} SET hits=hits+1,accessed=? WHERE barcode=(?);"
 
-		rawInsert = `INSERT INTO barcodes(barcode,isbn,author,title)
-		SELECT ?,?,?,?
-		WHERE NOT EXISTS (SELECT * FROM barcodes WHERE barcode=(?));`
+		rawMarkFetched = "UPDATE {table} SET fetched=? WHERE barcode=(?);"
+
+		rawStaleOldest = `SELECT barcode,isbn,author,title,source,isbns,symbology,fetched
+		FROM {table} WHERE fetched<? ORDER BY fetched,barcode {limit};`
+
+		rawStalePopular = `SELECT barcode,isbn,author,title,source,isbns,symbology,fetched
+		FROM {table} WHERE fetched<? ORDER BY hits DESC,fetched,barcode {limit};`
+
+		// Random sample of items, e.g. for auditing
+		rawSample = `SELECT barcode,isbn,author,title,source,isbns,symbology,fetched
+		FROM {table} ORDER BY %s {limit};`
+
+		rawDeleteItem = "DELETE FROM {table} WHERE barcode=(?);"
+
+		// Canonical ISBN-13 lists for rows stored before they were kept
+		rawPageISBNs = `SELECT id,barcode,isbn FROM {table}
+		WHERE id>? AND isbns='' AND isbn<>'' ORDER BY id {limit};`
+
+		rawUpdateISBNs = "UPDATE {table} SET isbns=? WHERE barcode=(?);"
+
+		// Symbologies for rows stored before they were recorded
+		rawPageSymbologies = `SELECT id,barcode,barcode FROM {table}
+		WHERE id>? AND symbology='' ORDER BY id {limit};`
+
+		rawUpdateSymbology = "UPDATE {table} SET symbology=? WHERE barcode=(?);"
+
+		// Folded search text for rows stored before it was kept
+		rawPageSearch = `SELECT id,barcode,%s FROM {table}
+		WHERE id>? AND search='' ORDER BY id {limit};`
+
+		rawUpdateSearch = "UPDATE {table} SET search=? WHERE barcode=(?);"
+
+		rawLookupRaw = "SELECT source,raw FROM {table} WHERE barcode=(?);"
+
+		rawPageRaw = `SELECT id,barcode,source,raw FROM {table}
+		WHERE id>? AND raw IS NOT NULL ORDER BY id {limit};`
+
+		// Index of canonical ISBN-13s, for finding all copies of a title
+		rawSetupISBNs = `CREATE TABLE IF NOT EXISTS {table}_isbns(
+		isbn    varchar(13) NOT NULL,
+		barcode varchar(50) NOT NULL,
+		PRIMARY KEY (isbn,barcode));`
+
+		rawDeleteISBNs = "DELETE FROM {table}_isbns WHERE barcode=(?);"
+
+		rawInsertISBN = "INSERT INTO {table}_isbns(isbn,barcode) VALUES (?,?);"
+
+		rawLookupISBN = `SELECT b.barcode,b.isbn,b.author,b.title,b.source,b.isbns,b.symbology,b.fetched
+		FROM {table} b JOIN {table}_isbns i ON i.barcode=b.barcode
+		WHERE i.isbn=(?) ORDER BY b.barcode;`
+
+		rawCountISBNs = "SELECT COUNT(*) FROM {table}_isbns;"
+
+		rawPageISBNIndex = `SELECT id,barcode,isbns FROM {table}
+		WHERE id>? AND isbns<>'' ORDER BY id {limit};`
+
+		// Keyword search, per dialect. The match expression is built by
+		// searchArgs(); LIKE has one "search LIKE ?" condition per term.
+		rawSearchFTS5 = `SELECT b.barcode,b.isbn,b.author,b.title,b.source,b.isbns,b.symbology,b.fetched
+		FROM {table}_fts f JOIN {table} b ON b.barcode=f.barcode
+		WHERE {table}_fts MATCH ? ORDER BY f.rank,b.barcode {limit_offset};`
+
+		rawSearchLike = `SELECT barcode,isbn,author,title,source,isbns,symbology,fetched
+		FROM {table} WHERE %s ORDER BY title,barcode {limit_offset};`
+
+		rawSearchTSVector = `SELECT barcode,isbn,author,title,source,isbns,symbology,fetched
+		FROM {table} WHERE to_tsvector('simple',search) @@ to_tsquery('simple',?)
+		ORDER BY ts_rank(to_tsvector('simple',search),to_tsquery('simple',?)) DESC,barcode
+		{limit_offset};`
+
+		rawSearchFulltext = `SELECT barcode,isbn,author,title,source,isbns,symbology,fetched
+		FROM {table} WHERE MATCH(search) AGAINST (? IN BOOLEAN MODE)
+		ORDER BY MATCH(search) AGAINST (? IN BOOLEAN MODE) DESC,barcode
+		{limit_offset};`
+
+		// Listing, with filter conditions and ordering filled in by List()
+		rawListItems = `SELECT barcode,isbn,author,title,source,isbns,symbology,fetched
+		FROM {table} WHERE %s ORDER BY %s {limit};`
+
+		rawIndexFTS5 = "CREATE VIRTUAL TABLE IF NOT EXISTS {table}_fts USING fts5(barcode UNINDEXED, search);"
+		rawIndexTSVector = "CREATE INDEX IF NOT EXISTS {table}_search ON {table} USING GIN (to_tsvector('simple',search));"
+		rawIndexFulltext = "CREATE FULLTEXT INDEX {table}_search ON {table}(search);"
+
+		rawDeleteFTS = "DELETE FROM {table}_fts WHERE barcode=(?);"
+		rawInsertFTS = "INSERT INTO {table}_fts(barcode,search) VALUES (?,?);"
+		rawClearFTS = "DELETE FROM {table}_fts;"
+
+		// Items to index, index entries, and entries matching their items
+		rawCheckFTS = `SELECT (SELECT COUNT(*) FROM {table} WHERE search<>''),
+		(SELECT COUNT(*) FROM {table}_fts),
+		(SELECT COUNT(*) FROM {table}_fts f JOIN {table} b ON b.barcode=f.barcode AND b.search=f.search);`
+		rawPageFTS = `SELECT id,barcode,search FROM {table}
+		WHERE id>? AND search<>'' ORDER BY id {limit};`
+
+		// Generic HTTP responses, keyed on a hash of the upstream URL
+		rawSetupResponses = `CREATE TABLE IF NOT EXISTS {table}_responses(
+		id           %s          PRIMARY KEY,
+		cache_key    varchar(64) NOT NULL UNIQUE,
+		url          text        NOT NULL,
+		status       int         NOT NULL,
+		content_type text        NOT NULL,
+		body         %s,
+		fetched      bigint      NOT NULL);`
+
+		rawLookupResponse = `SELECT url,status,content_type,body,fetched
+		FROM {table}_responses WHERE cache_key=(?);`
+
+		rawUpsertResponse = `INSERT INTO {table}_responses(cache_key,url,status,content_type,body,fetched)
+		VALUES (?,?,?,?,%s,?) %s;`
 	)
 
-	varReplace := func(src string, varPrefix string) (string,error) {
-		builder := strings.Builder {}
-		varIndex := 1
-		for _,r := range src {
-			if r == '?' {
-				_, err := builder.WriteString(fmt.Sprintf("%s%d",varPrefix,varIndex))
-				if err != nil { return "",err }
-				varIndex++
-			} else {
-				_, err := builder.WriteRune(r)
-				if err != nil { return "",err }
-			}
-		}
-		return builder.String(), nil
+	// Modified according to database type
+	idInfo, blobInfo, rawVar := dialect.IdentityType(), dialect.BlobType(), dialect.BlobVar()
+	searchSource := dialect.Concat("title","' '","author")
+
+	s.textSearch, s.searchLike = dialect.TextSearch(), rawSearchLike
+	switch s.textSearch {
+		case "fts5": s.search, s.searchIndex = rawSearchFTS5, rawIndexFTS5
+		case "tsvector": s.search, s.searchIndex = rawSearchTSVector, rawIndexTSVector
+		case "fulltext": s.search, s.searchIndex = rawSearchFulltext, rawIndexFulltext
+		default: s.textSearch = "like"
 	}
 
-	// Modified according to database type
-	idInfo := "int GENERATED BY DEFAULT AS IDENTITY"
-	varPrefix := ""
+	s.setup = []string {
+		fmt.Sprintf(rawSetup, idInfo, blobInfo),
+		fmt.Sprintf(rawSetupResponses, idInfo, blobInfo),
+		rawSetupISBNs,
+	}
+	s.lookup, s.update, s.lookupRaw, s.pageRaw = rawLookup, rawUpdate, rawLookupRaw, rawPageRaw
+	upsert := func(policy string) string {
+		return fmt.Sprintf(rawUpsert, rawVar, dialect.Upsert("{table}", "barcode", itemColumns, policy))
+	}
+	s.upsertSkip, s.upsertOverwrite, s.upsertNewest = upsert("skip"), upsert("overwrite"), upsert("newest")
+	s.lookupFetched = rawLookupFetched
+	s.recordAccess, s.markFetched = rawRecordAccess, rawMarkFetched
+	s.staleOldest, s.stalePopular = rawStaleOldest, rawStalePopular
+	s.sample, s.deleteItem = fmt.Sprintf(rawSample, dialect.Random()), rawDeleteItem
+	s.pageISBNs, s.updateISBNs = rawPageISBNs, rawUpdateISBNs
+	s.pageSymbologies, s.updateSymbology = rawPageSymbologies, rawUpdateSymbology
+	s.deleteISBNs, s.insertISBN, s.lookupISBN = rawDeleteISBNs, rawInsertISBN, rawLookupISBN
+	s.countISBNs, s.pageISBNIndex = rawCountISBNs, rawPageISBNIndex
+	s.lookupResponse = rawLookupResponse
+	s.upsertResponse = fmt.Sprintf(rawUpsertResponse, rawVar,
+		dialect.Upsert("{table}_responses", "cache_key", responseColumns, "overwrite"))
+	s.pageSearch, s.updateSearch = fmt.Sprintf(rawPageSearch, searchSource), rawUpdateSearch
+	s.deleteFTS, s.insertFTS, s.pageFTS = rawDeleteFTS, rawInsertFTS, rawPageFTS
+	s.checkFTS, s.clearFTS = rawCheckFTS, rawClearFTS
 
-	switch strings.ToLower(dbType) {
-		case "mysql":
-			idInfo = "int AUTO_INCREMENT"
-		case "sqlite":
-			idInfo = "integer"
-		case "postgres":
-			// Postgres will get SELECT variables as $1, $2, ...
-			varPrefix = "$"
-		default:
-			return fmt.Errorf("Unknown database type " + dbType)
-//		case "oracle":
-//			// Oracle will get SELECT variables as :var1, :var2, ...
-//			varPrefix = ":var"
+	// Columns missing from databases created by earlier versions
+	s.columns = []sqlColumn {
+		{"source", "varchar(50) NOT NULL DEFAULT ''", nil},
+		{"raw", blobInfo, nil},
+		{"isbns", dialect.TextColumn(), s.backfillISBNs},
+		{"symbology", "varchar(20) NOT NULL DEFAULT ''", s.backfillSymbologies},
+		{"search", dialect.TextColumn(), s.backfillSearch},
+		{"fetched", "bigint NOT NULL DEFAULT 0", nil}, // unknown for existing rows
+		{"hits", "bigint NOT NULL DEFAULT 0", nil},
+		{"accessed", "bigint NOT NULL DEFAULT 0", nil},
 	}
 
-	s.setup = fmt.Sprintf(rawSetup, idInfo)
-	s.lookup, s.insert = rawLookup, rawInsert
+	s.dialect, s.table = dialect, table
+	tableReplace := strings.NewReplacer("{table}",table,
+		"{limit}",dialect.Limit(false), "{limit_offset}",dialect.Limit(true))
 
-	if varPrefix != "" {
-		lookup, err := varReplace(rawLookup,varPrefix)
-		if err != nil {return err}
+	// Variables are only bound once List() or Search() has added its conditions
+	s.listItems, s.searchLike = tableReplace.Replace(rawListItems), tableReplace.Replace(s.searchLike)
 
-		insert, err := varReplace(rawInsert,varPrefix)
-		if err != nil {return err}
+	procedures := []*string {&s.lookup, &s.upsertSkip, &s.upsertOverwrite, &s.upsertNewest,
+		&s.update, &s.lookupFetched,
+		&s.recordAccess, &s.markFetched, &s.staleOldest, &s.stalePopular,
+		&s.sample, &s.deleteItem, &s.lookupRaw, &s.pageRaw, &s.pageISBNs, &s.updateISBNs,
+		&s.pageSymbologies, &s.updateSymbology,
+		&s.deleteISBNs, &s.insertISBN, &s.lookupISBN, &s.countISBNs, &s.pageISBNIndex,
+		&s.lookupResponse, &s.upsertResponse,
+		&s.pageSearch, &s.updateSearch, &s.search, &s.searchIndex,
+		&s.deleteFTS, &s.insertFTS, &s.checkFTS, &s.clearFTS, &s.pageFTS}
+	for i := range s.setup { procedures = append(procedures,&s.setup[i]) }
 
-		s.lookup, s.insert = lookup, insert
-	}
+	for _, p := range procedures { *p = bindVars(tableReplace.Replace(*p),dialect) }
 
 	/*
 	log.Println("SQL strings for database type " + dbType + ":")
-	log.Println(" - Setup: " + s.setup)
+	log.Println(" - Setup: " + strings.Join(s.setup,"\n"))
 	log.Println(" - Lookup: " + s.lookup)
-	log.Println(" - Insert: " + s.insert)
+	log.Println(" - Upsert: " + s.upsertNewest)
+	log.Println(" - Update: " + s.update)
 	*/
 
 	return nil
 }
 
-// Sets the internal SQL database object and executes the SQL setup procedure
-func (s *SQLShim) SetupDatabase(db *sql.DB) (error) {
+// Sets the internal SQL database objects and executes the SQL setup
+// procedure. Given a separate pool for reads, db has a single connection,
+// written by a single writer goroutine; otherwise db is used for both.
+func (s *SQLShim) SetupDatabase(db *sql.DB, reader *sql.DB) (error) {
 	if db == nil { log.Fatalln("Database is nil!") }
 
-	s.db = db
+	s.db, s.reader = db, db
+	if reader != nil { s.reader = reader }
+
+	s.reader.SetMaxOpenConns(s.limits.maxOpen)
+	if s.limits.maxIdle != 0 { s.reader.SetMaxIdleConns(s.limits.maxIdle) }
+	s.reader.SetConnMaxLifetime(s.limits.lifetime)
+
+	if reader != nil {
+		s.db.SetMaxOpenConns(1)
+		s.db.SetMaxIdleConns(1)
+	}
+
+	for _, setup := range s.setup {
+		_, err := s.db.Exec(setup)
+		if err != nil && s.textSearch == "fts5" && strings.Contains(err.Error(),"no such module: fts5") {
+			return fmt.Errorf("the database has a FTS5 search index, which this build lacks: build with -tags sqlite_fts5")
+		}
+		if err != nil { return err }
+	}
+
+	// Probe for each later column, and add it if the probe fails
+	for _, col := range s.columns {
+		_, err := s.db.Exec("SELECT "+col.name+" FROM "+s.table+" WHERE 1=0;")
+		if err == nil { continue }
+
+		log.Println("Adding column '"+col.name+"' to "+s.table+" table ...")
+		_, err = s.db.Exec("ALTER TABLE "+s.table+" ADD COLUMN "+col.name+" "+col.definition+";")
+		if err != nil { return err }
+
+		if col.backfill != nil {
+			if err := col.backfill(); err != nil { return err }
+		}
+	}
+
+	// Widen columns older versions created as varchar, as ISBN lists can be
+	// long (multi-volume sets)
+	for _, column := range []string {"isbns"} {
+		alter := s.dialect.AlterToText(s.table,column)
+		if alter == "" { continue }
+
+		// Only our own schema, as other databases may hold a table of the same name
+		var narrow int
+		err := s.db.QueryRow(bindVars(`SELECT COUNT(*) FROM information_schema.columns
+			WHERE table_schema=`+s.dialect.CurrentSchema()+` AND table_name=? AND column_name=? AND data_type LIKE '%char%';`,s.dialect), s.table, column).Scan(&narrow)
+		if err != nil { return err }
+		if narrow == 0 { continue }
+
+		log.Println("Changing column '"+column+"' of "+s.table+" table to text ...")
+		if _, err := s.db.Exec(alter); err != nil { return err }
+	}
+
+	// Build the ISBN index if it is new
+	var indexed int64
+	if err := s.db.QueryRow(s.countISBNs).Scan(&indexed); err != nil { return err }
+	if indexed == 0 {
+		err := s.backfill(s.pageISBNIndex, func(barcode, isbns string) error {
+			tx, err := s.db.Begin()
+			if err != nil { return err }
+			if err := s.writeISBNs(tx,barcode,splitISBNs(isbns)); err != nil { tx.Rollback(); return err }
+			return tx.Commit()
+		})
+		if err != nil { return err }
+	}
+
+	if err := s.setupSearch(); err != nil { return err }
+
+	if reader != nil {
+		s.writes, s.writerDone = make(chan sqlWrite), make(chan struct{})
+		go s.writer(s.writes,s.writerDone)
+	}
+	return nil
+}
+
+// Creates the full-text index for the dialect. SQLite builds lacking FTS5
+// (it needs the sqlite_fts5 build tag) fail, unless allowed to fall back to
+// LIKE matching. The FTS5 index is rebuilt if it does not match the table,
+// e.g. after items were stored by a build lacking FTS5.
+func (s *SQLShim) setupSearch() (error) {
+	switch s.textSearch {
+		case "tsvector":
+			_, err := s.db.Exec(s.searchIndex)
+			return err
+
+		case "fulltext":
+			// MySQL has no CREATE INDEX IF NOT EXISTS; probe with a search instead
+			if _, err := s.db.Exec(s.search,"x","x",0,0); err == nil { return nil }
+			_, err := s.db.Exec(s.searchIndex)
+			return err
 
-	_, err := s.db.Exec(s.setup)
+		case "fts5":
+			if _, err := s.db.Exec(s.searchIndex); err != nil {
+				if !s.likeSearch { return fmt.Errorf("FTS5 unavailable (%v): build with -tags sqlite_fts5, or give -db_like_search", err) }
+
+				log.Println("FTS5 unavailable ("+err.Error()+"); searching with LIKE instead")
+				s.textSearch = "like"
+				return nil
+			}
+
+			var items, indexed, matching int64
+			if err := s.db.QueryRow(s.checkFTS).Scan(&items,&indexed,&matching); err != nil { return err }
+			if items == indexed && indexed == matching { return nil }
+
+			log.Println(fmt.Sprintf("Rebuilding search index of %s table (%d of %d items indexed as stored) ...", s.table, matching, items))
+			if _, err := s.db.Exec(s.clearFTS); err != nil { return err }
+
+			return s.backfill(s.pageFTS, func(barcode, search string) error {
+				tx, err := s.db.Begin()
+				if err != nil { return err }
+				if err := s.writeFTS(tx,barcode,search); err != nil { tx.Rollback(); return err }
+				return tx.Commit()
+			})
+	}
+
+	return nil
+}
+
+// Replaces the FTS5 index entry for a barcode; other dialects index the table itself
+func (s *SQLShim) writeFTS(tx *sql.Tx, barcode string, search string) (error) {
+	if s.textSearch != "fts5" { return nil }
+
+	if _, err := tx.Exec(s.deleteFTS,barcode); err != nil { return err }
+	if search == "" { return nil }
+
+	_, err := tx.Exec(s.insertFTS,barcode,search)
 	return err
 }
 
+// Returns the query and arguments searching for all the (folded) terms
+func (s *SQLShim) searchArgs(terms []string, limit, offset int) (string, []interface{}) {
+	args := []interface{} {}
+
+	switch s.textSearch {
+		case "fts5":
+			quoted := []string {}
+			for _, t := range terms { quoted = append(quoted,`"`+t+`"*`) }
+			args = append(args,strings.Join(quoted," "))
+			return s.search, append(args,limit,offset)
+
+		case "tsvector":
+			expr := strings.Join(terms,":* & ")+":*"
+			return s.search, append(args,expr,expr,limit,offset)
+
+		case "fulltext":
+			expr := "+"+strings.Join(terms,"* +")+"*"
+			return s.search, append(args,expr,expr,limit,offset)
+	}
+
+	conditions := []string {}
+	for _, t := range terms {
+		conditions = append(conditions,"search LIKE ?")
+		args = append(args,"%"+t+"%")
+	}
+	query := fmt.Sprintf(s.searchLike,strings.Join(conditions," AND "))
+	return bindVars(query,s.dialect), append(args,limit,offset)
+}
+
+// Replaces the ISBN index entries for a barcode
+func (s *SQLShim) writeISBNs(tx *sql.Tx, barcode string, isbns []string) (error) {
+	if _, err := tx.Exec(s.deleteISBNs,barcode); err != nil { return err }
+
+	for _, isbn := range isbns {
+		if _, err := tx.Exec(s.insertISBN,isbn,barcode); err != nil { return err }
+	}
+
+	return nil
+}
+
+// Returns a BarcodeItem from the current row; columns as for the lookup procedure
+func scanItem(row interface{ Scan(...interface{}) error }) (*BarcodeItem, error) {
+	tmp := BarcodeItem {}
+	var isbns string
+	var fetched int64
+
+	err := row.Scan(&tmp.Barcode,&tmp.ISBN,&tmp.Author,&tmp.Title,&tmp.Source,&isbns,&tmp.Symbology,&fetched)
+	if err != nil { return nil, err }
+
+	tmp.ISBNs = isbnForms(splitISBNs(isbns))
+	if fetched > 0 {
+		t := time.Unix(fetched,0).UTC()
+		tmp.Fetched = &t
+	}
+	return &tmp, nil
+}
+
 // Returns a BarcodeItem from the database
 func (s *SQLShim) Lookup(barcode string) (*BarcodeItem, error) {
 	if s.db == nil { log.Fatalln("Database is nil!") }
 	if barcode == "" { log.Fatalln("Empty barcode!") }
 
-	rows, err := s.db.Query(s.lookup,barcode)
+	rows, err := s.reader.Query(s.lookup,barcode)
 	if err != nil { return nil, err }
 
 	defer rows.Close()
 
 	for rows.Next() {
-		tmp := BarcodeItem {Barcode: barcode}
+		return scanItem(rows)
+	}
+
+	return nil, nil
+}
+
+// Returns every BarcodeItem with the given canonical ISBN-13
+func (s *SQLShim) LookupISBN(isbn string) ([]*BarcodeItem, error) {
+	if s.db == nil { log.Fatalln("Database is nil!") }
+
+	rows, err := s.reader.Query(s.lookupISBN,isbn)
+	if err != nil { return nil, err }
+
+	defer rows.Close()
 
-		err := rows.Scan(&tmp.ISBN,&tmp.Author,&tmp.Title)
+	items := []*BarcodeItem {}
+	for rows.Next() {
+		item, err := scanItem(rows)
 		if err != nil { return nil, err }
+		items = append(items,item)
+	}
+
+	return items, rows.Err()
+}
+
+// Returns the BarcodeItems matching all of the folded search terms, best first
+func (s *SQLShim) Search(terms []string, limit, offset int) ([]*BarcodeItem, error) {
+	if s.db == nil { log.Fatalln("Database is nil!") }
+
+	items := []*BarcodeItem {}
+	if len(terms) == 0 { return items, nil }
+
+	query, args := s.searchArgs(terms,limit,offset)
+
+	rows, err := s.reader.Query(query,args...)
+	if err != nil { return nil, err }
 
-		return &tmp, nil
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil { return nil, err }
+		items = append(items,item)
 	}
 
-	return nil, nil
+	return items, rows.Err()
 }
 
-// Stores BarcodeItem in the database
+// Returns a page of BarcodeItems matching the query's filters, in its order
+func (s *SQLShim) List(q ListQuery) ([]*BarcodeItem, error) {
+	if s.db == nil { log.Fatalln("Database is nil!") }
+
+	conditions := []string {"1=1"}
+	args := []interface{} {}
+
+	if q.Source != "" {
+		conditions = append(conditions,"source=?")
+		args = append(args,q.Source)
+	}
+	if q.Missing != "" {
+		// Field names are checked by parseListQuery()
+		conditions = append(conditions,q.Missing+"=''")
+	}
+	if q.AuthorPrefix != "" {
+		escaped := strings.NewReplacer("!","!!", "%","!%", "_","!_").Replace(strings.ToLower(q.AuthorPrefix))
+		conditions = append(conditions,"LOWER(author) LIKE ? ESCAPE '!'")
+		args = append(args,escaped+"%")
+	}
+	if !q.FetchedSince.IsZero() {
+		conditions = append(conditions,"fetched>=?")
+		args = append(args,q.FetchedSince.Unix())
+	}
+
+	// Rows after the cursor, as ordered by (sort column, barcode)
+	op, dir := ">", "ASC"
+	if q.Descending { op, dir = "<", "DESC" }
+
+	order := "barcode "+dir
+	if q.Sort != "barcode" { order = q.Sort+" "+dir+",barcode "+dir }
+
+	if q.After != nil {
+		var value interface{} = q.After.Value
+		if q.Sort == "fetched" {
+			n, err := strconv.ParseInt(q.After.Value,10,64)
+			if err != nil { return nil, err }
+			value = n
+		}
+
+		if q.Sort == "barcode" {
+			conditions = append(conditions,"barcode"+op+"?")
+			args = append(args,q.After.Barcode)
+		} else {
+			conditions = append(conditions,"("+q.Sort+op+"? OR ("+q.Sort+"=? AND barcode"+op+"?))")
+			args = append(args,value,value,q.After.Barcode)
+		}
+	}
+
+	query := fmt.Sprintf(s.listItems,strings.Join(conditions," AND "),order)
+	args = append(args,q.Limit)
+
+	rows, err := s.reader.Query(bindVars(query,s.dialect),args...)
+	if err != nil { return nil, err }
+
+	defer rows.Close()
+
+	items := []*BarcodeItem {}
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil { return nil, err }
+		items = append(items,item)
+	}
+
+	return items, rows.Err()
+}
+
+// Stores BarcodeItem in the database; an item already present is handled
+// according to the conflict policy (default "newest")
 func (s *SQLShim) Store(item *BarcodeItem) (error) {
 	if s.db == nil { log.Fatalln("Database is nil!") }
 	if item == nil { log.Fatalln("Item is nil!") }
 	if item.Barcode == "" { log.Fatalln("Barcode is empty!") }
 
-	_, err := s.db.Exec(s.insert,
+	policy := s.conflict
+	if policy == "" { policy = "newest" }
+
+	return s.write(func(tx *sql.Tx) error {
+		_, err := s.upsertItem(tx,item,policy)
+		return err
+	})
+}
+
+// Inserts an item, or resolves its conflict with an existing one according
+// to policy, with its index entries; returns true if the row was written.
+func (s *SQLShim) upsertItem(tx *sql.Tx, item *BarcodeItem, policy string) (bool, error) {
+	var query string
+	switch policy {
+		case "skip": query = s.upsertSkip
+		case "overwrite": query = s.upsertOverwrite
+		case "newest": query = s.upsertNewest
+		default: return false, fmt.Errorf("unknown conflict policy '%s' (use skip, overwrite or newest)", policy)
+	}
+
+	raw, err := compress(item.Raw)
+	if err != nil { return false, err }
+
+	search := searchText(item)
+
+	// Items passed on by other caches keep their original fetch time
+	fetched := time.Now().Unix()
+	if item.Fetched != nil { fetched = item.Fetched.Unix() }
+
+	res, err := tx.Exec(query,
 		item.Barcode,
 		item.ISBN,
 		item.Author,
 		item.Title,
-		item.Barcode )
-	
-	return err
+		item.Source,
+		raw,
+		joinISBNs(item.ISBN),
+		barcodeSymbology(item.Barcode),
+		search,
+		fetched )
+	if err != nil { return false, err }
+
+	// Only index the ISBNs and text if the row was actually written. The
+	// write locks the row, so concurrent writers of the barcode wait here.
+	if n, err := res.RowsAffected(); err != nil || n == 0 { return false, err }
+
+	if err := s.writeISBNs(tx,item.Barcode,parseISBNs(item.ISBN)); err != nil { return false, err }
+	if err := s.writeFTS(tx,item.Barcode,search); err != nil { return false, err }
+
+	return true, nil
 }
 
+// Stores a batch of items in one transaction. Items already present are
+// handled according to policy: "skip" leaves them, "overwrite" replaces
+// them, and "newest" replaces them only if the new item was fetched later.
+func (s *SQLShim) Import(items []*BarcodeItem, policy string) (ImportResult, error) {
+	if s.db == nil { log.Fatalln("Database is nil!") }
 
-//
-// SQLite
-//
+	result := ImportResult {}
 
-type SQLiteServer struct {
-	shim SQLShim
+	err := s.write(func(tx *sql.Tx) error {
+		result = ImportResult {}
+
+		for _, item := range items {
+			var fetched int64
+			err := tx.QueryRow(s.lookupFetched,item.Barcode).Scan(&fetched)
+			if err != nil && err != sql.ErrNoRows { return err }
+			exists := err == nil
+
+			// Without a fetch time, an item cannot be newer
+			if exists && policy == "newest" && item.Fetched == nil {
+				result.Skipped++
+				continue
+			}
+
+			written, err := s.upsertItem(tx,item,policy)
+			switch {
+				case err != nil: return err
+				case !written: result.Skipped++
+				case exists: result.Updated++
+				default: result.Inserted++
+			}
+		}
+
+		return nil
+	})
+	if err != nil { return ImportResult {}, err }
+
+	return result, nil
 }
 
-// params = SQLite file path
-func (s *SQLiteServer) Startup(params string) {
-	s.Shutdown()
+// Counts a request served with the item
+func (s *SQLShim) RecordAccess(barcode string) (error) {
+	if s.db == nil { log.Fatalln("Database is nil!") }
 
-	filePath := params
+	now := time.Now().Unix()
+	return s.write(func(tx *sql.Tx) error {
+		_, err := tx.Exec(s.recordAccess,now,barcode)
+		return err
+	})
+}
+
+// Returns up to limit items fetched before the given time, oldest first or
+// (order = "popular") most requested first
+func (s *SQLShim) Stale(order string, before time.Time, limit int) ([]*BarcodeItem, error) {
+	if s.db == nil { log.Fatalln("Database is nil!") }
+
+	query := s.staleOldest
+	if order == "popular" { query = s.stalePopular }
+
+	rows, err := s.reader.Query(query,before.Unix(),limit)
+	if err != nil { return nil, err }
 
-	info, err := os.Stat(filePath)
-	if os.IsNotExist(err) || info.IsDir() {
-		log.Println("Database file '"+filePath+"' does not exist; creating ...")
-		os.Create(filePath)
+	defer rows.Close()
+
+	items := []*BarcodeItem {}
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil { return nil, err }
+		items = append(items,item)
 	}
 
-	db, err := sql.Open("sqlite3",filePath)
-	boom(err, "Unable to open SQLite database "+filePath)
+	return items, rows.Err()
+}
 
-	err = s.shim.InitProcedures("SQLite")
-	boom(err, "Unable to initialize procedures")
+// Replaces an item with a fresh copy from upstream, keeping its access counts
+func (s *SQLShim) Refresh(item *BarcodeItem) (error) {
+	if s.db == nil { log.Fatalln("Database is nil!") }
+	if item == nil { log.Fatalln("Item is nil!") }
 
-	err = s.shim.SetupDatabase(db)
-	boom(err, "Unable to set up database ")
+	return s.write(func(tx *sql.Tx) error {
+		_, err := s.upsertItem(tx,item,"overwrite")
+		return err
+	})
 }
 
-// Closes internal database object
-func (s *SQLiteServer) Shutdown() {
-	if s.shim.db != nil { s.shim.db.Close() }
-	s.shim.db = nil
+// Sets the time an item was last checked upstream, without changing it
+func (s *SQLShim) MarkFetched(barcode string, when time.Time) (error) {
+	if s.db == nil { log.Fatalln("Database is nil!") }
+
+	return s.write(func(tx *sql.Tx) error {
+		_, err := tx.Exec(s.markFetched,when.Unix(),barcode)
+		return err
+	})
 }
 
-// Returns a BarcodeItem from the database
-func (s *SQLiteServer) Lookup(barcode string) (*BarcodeItem) {
-	result, err := s.shim.Lookup(barcode)
-	boom(err, "Unable to lookup item")
-	return result
+// Returns up to n items chosen at random
+func (s *SQLShim) Sample(n int) ([]*BarcodeItem, error) {
+	if s.db == nil { log.Fatalln("Database is nil!") }
+
+	rows, err := s.reader.Query(s.sample,n)
+	if err != nil { return nil, err }
+
+	defer rows.Close()
+
+	items := []*BarcodeItem {}
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil { return nil, err }
+		items = append(items,item)
+	}
+
+	return items, rows.Err()
 }
 
-// Stores a BarcodeItem in the database
-func (s *SQLiteServer) Store(item *BarcodeItem) {
-	err := s.shim.Store(item)
-	boom(err, "Unable to store item")
+// Removes an item, with its index entries
+func (s *SQLShim) Delete(barcode string) (error) {
+	if s.db == nil { log.Fatalln("Database is nil!") }
+
+	return s.write(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(s.deleteItem,barcode); err != nil { return err }
+		if err := s.writeISBNs(tx,barcode,nil); err != nil { return err }
+		return s.writeFTS(tx,barcode,"")
+	})
 }
 
-//
-// Postgres
-//
+// Overwrites the normalized fields of an existing BarcodeItem; the raw payload is untouched
+func (s *SQLShim) Update(item *BarcodeItem) (error) {
+	if s.db == nil { log.Fatalln("Database is nil!") }
+	if item == nil { log.Fatalln("Item is nil!") }
+	if item.Barcode == "" { log.Fatalln("Barcode is empty!") }
 
-type PostgresServer struct {
-	shim SQLShim
+	search := searchText(item)
+
+	return s.write(func(tx *sql.Tx) error {
+		_, err := tx.Exec(s.update,
+			item.ISBN,
+			item.Author,
+			item.Title,
+			item.Source,
+			joinISBNs(item.ISBN),
+			search,
+			item.Barcode )
+		if err != nil { return err }
+
+		if err := s.writeISBNs(tx,item.Barcode,parseISBNs(item.ISBN)); err != nil { return err }
+		return s.writeFTS(tx,item.Barcode,search)
+	})
 }
 
-// params = Postgres connection string
-func (s *PostgresServer) Startup(params string) {
-	s.Shutdown()
+// Returns the decompressed raw upstream payload and its source, or nil if absent
+func (s *SQLShim) LookupRaw(barcode string) ([]byte, string, error) {
+	if s.db == nil { log.Fatalln("Database is nil!") }
+	if barcode == "" { log.Fatalln("Empty barcode!") }
 
-	what, connStr := "postgres", params
+	var source string
+	var raw []byte
 
-	db, err := sql.Open(what,connStr)
-	boom(err, "Unable to open "+what+" database "+connStr)
+	err := s.reader.QueryRow(s.lookupRaw,barcode).Scan(&source,&raw)
+	if err == sql.ErrNoRows { return nil, "", nil }
+	if err != nil { return nil, "", err }
 
-	err = s.shim.InitProcedures(what)
-	boom(err, "Unable to initialize procedures")
+	raw, err = decompress(raw)
+	return raw, source, err
+}
 
-	err = s.shim.SetupDatabase(db)
-	boom(err, "Unable to set up database ")
+// Calls fn on every stored raw payload. Rows are read a page at a time and
+// the page closed before fn is called, so fn may safely write to the database.
+func (s *SQLShim) EachRaw(fn func(barcode, source string, raw []byte)) (error) {
+	if s.db == nil { log.Fatalln("Database is nil!") }
+
+	type entry struct {
+		barcode, source string
+		raw []byte
+	}
+
+	const pageSize = 100
+	lastID := int64(0)
+
+	for {
+		rows, err := s.reader.Query(s.pageRaw,lastID,pageSize)
+		if err != nil { return err }
+
+		page := []entry {}
+		for rows.Next() {
+			e := entry {}
+			err := rows.Scan(&lastID,&e.barcode,&e.source,&e.raw)
+			if err != nil { rows.Close(); return err }
+			page = append(page,e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil { return err }
+
+		for _, e := range page {
+			raw, err := decompress(e.raw)
+			if err != nil { return err }
+			fn(e.barcode,e.source,raw)
+		}
+
+		if len(page) < pageSize { return nil }
+	}
 }
 
-// Closes internal database object
-func (s *PostgresServer) Shutdown() {
-	if s.shim.db != nil { s.shim.db.Close() }
-	s.shim.db = nil
+
+// Canonical ISBN-13 lists are stored ';'-separated
+func joinISBNs(isbn string) (string) {
+	return strings.Join(parseISBNs(isbn),";")
 }
 
-// Returns a BarcodeItem from the database
-func (s *PostgresServer) Lookup(barcode string) (*BarcodeItem) {
-	result, err := s.shim.Lookup(barcode)
-	boom(err, "Unable to lookup item")
-	return result
+func splitISBNs(isbns string) ([]string) {
+	if isbns == "" { return nil }
+	return strings.Split(isbns,";")
 }
 
-// Stores a BarcodeItem in the database
-func (s *PostgresServer) Store(item *BarcodeItem) {
-	log.Println(item)
-	err := s.shim.Store(item)
-	boom(err,"Unable to store item")
+// Calls update on every row returned by the paged query, which must select
+// id and barcode, then one further column, for rows with id greater than its
+// first argument. Rows are read a page at a time, as for EachRaw().
+func (s *SQLShim) backfill(pageQuery string, update func(barcode, value string) error) (error) {
+	type entry struct {
+		barcode, value string
+	}
+
+	const pageSize = 100
+	lastID := int64(0)
+
+	for {
+		rows, err := s.db.Query(pageQuery,lastID,pageSize)
+		if err != nil { return err }
+
+		page := []entry {}
+		for rows.Next() {
+			e := entry {}
+			err := rows.Scan(&lastID,&e.barcode,&e.value)
+			if err != nil { rows.Close(); return err }
+			page = append(page,e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil { return err }
+
+		for _, e := range page {
+			if err := update(e.barcode,e.value); err != nil { return err }
+		}
+
+		if len(page) < pageSize { return nil }
+	}
+}
+
+// Fills in the canonical ISBN-13 list for rows stored before it was kept
+func (s *SQLShim) backfillISBNs() (error) {
+	return s.backfill(s.pageISBNs, func(barcode, isbn string) error {
+		_, err := s.db.Exec(s.updateISBNs,joinISBNs(isbn),barcode)
+		return err
+	})
+}
+
+// Fills in the symbology for rows stored before it was recorded
+func (s *SQLShim) backfillSymbologies() (error) {
+	return s.backfill(s.pageSymbologies, func(barcode, _ string) error {
+		_, err := s.db.Exec(s.updateSymbology,barcodeSymbology(barcode),barcode)
+		return err
+	})
+}
+
+// Fills in the folded search text for rows stored before it was kept
+func (s *SQLShim) backfillSearch() (error) {
+	return s.backfill(s.pageSearch, func(barcode, text string) error {
+		_, err := s.db.Exec(s.updateSearch,foldText(text),barcode)
+		return err
+	})
+}
+
+// Returns a cached HTTP response, or nil if absent
+func (s *SQLShim) LookupResponse(key string) (*CachedResponse, error) {
+	if s.db == nil { log.Fatalln("Database is nil!") }
+
+	resp := CachedResponse { Key: key }
+	var fetched int64
+
+	err := s.reader.QueryRow(s.lookupResponse,key).Scan(&resp.URL,&resp.Status,&resp.ContentType,&resp.Body,&fetched)
+	if err == sql.ErrNoRows { return nil, nil }
+	if err != nil { return nil, err }
+
+	resp.Fetched = time.Unix(fetched,0)
+	resp.Body, err = decompress(resp.Body)
+	return &resp, err
+}
+
+// Stores a HTTP response, replacing any with the same key
+func (s *SQLShim) StoreResponse(resp *CachedResponse) (error) {
+	if s.db == nil { log.Fatalln("Database is nil!") }
+	if resp == nil { log.Fatalln("Response is nil!") }
+
+	body, err := compress(resp.Body)
+	if err != nil { return err }
+
+	return s.write(func(tx *sql.Tx) error {
+		_, err := tx.Exec(s.upsertResponse,
+			resp.Key,
+			resp.URL,
+			resp.Status,
+			resp.ContentType,
+			body,
+			resp.Fetched.Unix() )
+		return err
+	})
 }
 
 //
-// MySQL
+// Generic SQL server, for any registered dialect
 //
 
-type MySQLServer struct {
+type SQLServer struct {
+	dialect Dialect
+	table string // empty = default table
+	conflict string // policy for items already stored (empty = newest)
+	limits poolLimits
+	batch int // most writes per transaction, where the dialect has a single writer
+	likeSearch bool // SQLite builds lacking FTS5 may search with LIKE, rather than fail
 	shim SQLShim
 }
 
-// params = MySQL connection string
-func (s *MySQLServer) Startup(params string) {
+// params = connection parameters, as made by the dialect's Params()
+func (s *SQLServer) Startup(params string) {
 	s.Shutdown()
 
-	what, connStr := "mysql", params
+	db, err := s.dialect.Open(params)
+	dbBoom(err, "Unable to open database "+params)
 
-	db, err := sql.Open(what,connStr)
-	boom(err, "Unable to open "+what+" database "+connStr)
+	reader, err := s.dialect.OpenReader(params)
+	if err != nil { db.Close() }
+	dbBoom(err, "Unable to open database "+params)
 
-	err = s.shim.InitProcedures(what)
-	boom(err, "Unable to initialize procedures")
+	s.shim.conflict = s.conflict
+	s.shim.limits = s.limits
+	s.shim.batch = s.batch
+	s.shim.likeSearch = s.likeSearch
+	err = s.shim.InitProcedures(s.dialect,s.table)
+	dbBoom(err, "Unable to initialize procedures")
 
-	err = s.shim.SetupDatabase(db)
-	boom(err, "Unable to set up database ")
+	err = s.shim.SetupDatabase(db,reader)
+	dbBoom(err, "Unable to set up database ")
 }
 
-// Closes internal database object
-func (s *MySQLServer) Shutdown() {
-	if s.shim.db != nil { s.shim.db.Close() }
-	s.shim.db = nil
+// Closes internal database objects
+func (s *SQLServer) Shutdown() {
+	s.shim.Close()
 }
 
 // Returns a BarcodeItem from the database
-func (s *MySQLServer) Lookup(barcode string) (*BarcodeItem) {
+func (s *SQLServer) Lookup(barcode string) (*BarcodeItem) {
 	result, err := s.shim.Lookup(barcode)
-	boom(err, "Unable to lookup item")
+	dbBoom(err, "Unable to lookup item")
 	return result
 }
 
 // Stores a BarcodeItem in the database
-func (s *MySQLServer) Store(item *BarcodeItem) {
+func (s *SQLServer) Store(item *BarcodeItem) {
 	err := s.shim.Store(item)
-	boom(err,"Unable to store item")
+	dbBoom(err, "Unable to store item")
+}
+
+// Overwrites the normalized fields of a BarcodeItem in the database
+func (s *SQLServer) Update(item *BarcodeItem) {
+	err := s.shim.Update(item)
+	dbBoom(err,"Unable to update item")
+}
+
+// Returns the raw upstream payload and its source for a barcode
+func (s *SQLServer) LookupRaw(barcode string) ([]byte, string) {
+	raw, source, err := s.shim.LookupRaw(barcode)
+	dbBoom(err, "Unable to lookup raw payload")
+	return raw, source
+}
+
+// Calls fn on every stored raw upstream payload
+func (s *SQLServer) EachRaw(fn func(barcode, source string, raw []byte)) {
+	err := s.shim.EachRaw(fn)
+	dbBoom(err, "Unable to iterate raw payloads")
+}
+
+// Returns every BarcodeItem in the database with the given ISBN-13
+func (s *SQLServer) LookupISBN(isbn string) ([]*BarcodeItem) {
+	items, err := s.shim.LookupISBN(isbn)
+	dbBoom(err, "Unable to lookup ISBN")
+	return items
+}
+
+// Returns the BarcodeItems in the database matching the search terms
+func (s *SQLServer) Search(terms []string, limit, offset int) ([]*BarcodeItem) {
+	items, err := s.shim.Search(terms,limit,offset)
+	dbBoom(err, "Unable to search items")
+	return items
+}
+
+// Returns a page of BarcodeItems from the database
+func (s *SQLServer) List(query ListQuery) ([]*BarcodeItem) {
+	items, err := s.shim.List(query)
+	dbBoom(err, "Unable to list items")
+	return items
+}
+
+// Stores a batch of BarcodeItems in the database, resolving conflicts by policy
+func (s *SQLServer) Import(items []*BarcodeItem, policy string) (ImportResult, error) {
+	return s.shim.Import(items,policy)
+}
+
+// Counts a request served with the item
+func (s *SQLServer) RecordAccess(barcode string) {
+	err := s.shim.RecordAccess(barcode)
+	dbBoom(err, "Unable to record access")
+}
+
+// Returns items from the database fetched before the given time
+func (s *SQLServer) Stale(order string, before time.Time, limit int) ([]*BarcodeItem) {
+	items, err := s.shim.Stale(order,before,limit)
+	dbBoom(err, "Unable to find stale items")
+	return items
+}
+
+// Replaces an item in the database with a fresh copy
+func (s *SQLServer) Refresh(item *BarcodeItem) {
+	err := s.shim.Refresh(item)
+	dbBoom(err, "Unable to refresh item")
+}
+
+// Sets the time an item in the database was last checked upstream
+func (s *SQLServer) MarkFetched(barcode string, when time.Time) {
+	err := s.shim.MarkFetched(barcode,when)
+	dbBoom(err, "Unable to mark item fetched")
+}
+
+// Returns up to n items from the database, chosen at random
+func (s *SQLServer) Sample(n int) ([]*BarcodeItem) {
+	items, err := s.shim.Sample(n)
+	dbBoom(err, "Unable to sample items")
+	return items
+}
+
+// Removes an item from the database
+func (s *SQLServer) Delete(barcode string) {
+	err := s.shim.Delete(barcode)
+	dbBoom(err, "Unable to delete item")
+}
+
+// Returns a cached HTTP response from the database
+func (s *SQLServer) LookupResponse(key string) (*CachedResponse) {
+	resp, err := s.shim.LookupResponse(key)
+	dbBoom(err, "Unable to lookup response")
+	return resp
+}
+
+// Stores a HTTP response in the database
+func (s *SQLServer) StoreResponse(resp *CachedResponse) {
+	err := s.shim.StoreResponse(resp)
+	dbBoom(err, "Unable to store response")
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+//
+// SQLite dialect. Full-text search uses FTS5, which needs the server built
+// with the sqlite_fts5 tag; other builds exit, unless given -db_like_search
+// to use LIKE matching. SQLite allows a single
+// writer at a time, so the database is opened in WAL mode, and writes are
+// made on one connection, apart from reads (see SQLShim.write()).
+//
+
+type SQLiteDialect struct {}
+
+func init() {
+	registerDialect("sqlite", SQLiteDialect {})
+
+	// The file cannot be opened, or read or written, e.g. on a lost mount
+	unreachableChecks = append(unreachableChecks, func(err error) (bool) {
+		var sqliteErr sqlite3.Error
+		if !errors.As(err,&sqliteErr) { return false }
+		return sqliteErr.Code == sqlite3.ErrCantOpen || sqliteErr.Code == sqlite3.ErrIoErr
+	})
+}
+
+// The database is a file named after the database, unless a URL gives its
+// path (sqlite:///path/name.db) or a URI as go-sqlite3 takes it, with options
+// (file:name.db?_busy_timeout=5000)
+func (SQLiteDialect) Params(c DBConfig) (string, error) {
+	if c.UseTLS() { return "", fmt.Errorf("TLS is not supported by SQLite") }
+
+	switch {
+		case c.URL == "": return c.Name+".sqlite.db", nil
+		case strings.HasPrefix(c.URL,"sqlite://"): return "file:"+strings.TrimPrefix(c.URL,"sqlite://"), nil
+		case strings.Contains(c.URL,"://"): return "", fmt.Errorf("Not a sqlite:// URL")
+	}
+	return c.URL, nil
+}
+
+// Connection options, unless the parameters give them (under either name):
+// in WAL mode reads go on while a write is made, and connections wait for
+// the database to be unlocked rather than fail at once. Writes take the lock
+// as soon as their transaction begins, so a reader cannot block them midway.
+var (
+	sqliteWriterOptions = []sqliteOption {
+		{"_journal_mode", "_journal", "WAL"},
+		{"_busy_timeout", "_timeout", "5000"},
+		{"_synchronous", "_sync", "NORMAL"},
+		{"_txlock", "", "immediate"},
+	}
+	sqliteReaderOptions = []sqliteOption {
+		{"_busy_timeout", "_timeout", "5000"},
+		{"_query_only", "", "true"},
+	}
+)
+
+type sqliteOption struct {
+	name, alias, value string
+}
+
+// Adds the options to a go-sqlite3 data source name
+func sqliteDSN(params string, options []sqliteOption) (string) {
+	path, query := params, ""
+	if i := strings.IndexByte(params,'?'); i >= 0 { path, query = params[:i], params[i+1:] }
+
+	given, _ := url.ParseQuery(query)
+	for _, o := range options {
+		if _, ok := given[o.name]; ok { continue }
+		if _, ok := given[o.alias]; ok && o.alias != "" { continue }
+
+		if query != "" { query += "&" }
+		query += o.name+"="+o.value
+	}
+
+	return path+"?"+query
+}
+
+// params = SQLite file path or URI
+func (SQLiteDialect) Open(params string) (*sql.DB, error) {
+	filePath := strings.TrimPrefix(params,"file:")
+	if i := strings.IndexByte(filePath,'?'); i >= 0 { filePath = filePath[:i] }
+
+	info, err := os.Stat(filePath)
+	if err != nil && !os.IsNotExist(err) { return nil, err }
+	if os.IsNotExist(err) || info.IsDir() {
+		log.Println("Database file '"+filePath+"' does not exist; creating ...")
+
+		// Closed at once: closing it later (e.g. when garbage collected) would
+		// drop the locks SQLite holds on the file
+		if file, err := os.Create(filePath); err == nil { file.Close() }
+	}
+
+	return sql.Open("sqlite3",sqliteDSN(params,sqliteWriterOptions))
+}
+
+// Only one connection can write at a time, so reads have their own
+func (SQLiteDialect) OpenReader(params string) (*sql.DB, error) {
+	return sql.Open("sqlite3",sqliteDSN(params,sqliteReaderOptions))
+}
+
+func (SQLiteDialect) Placeholder(n int) (string) { return "?" }
+func (SQLiteDialect) IdentityType() (string) { return "integer" }
+func (SQLiteDialect) BlobType() (string) { return "blob" }
+func (SQLiteDialect) BlobVar() (string) { return "?" }
+func (SQLiteDialect) TextColumn() (string) { return "text NOT NULL DEFAULT ''" }
+func (SQLiteDialect) Random() (string) { return "RANDOM()" }
+
+// Declared lengths are not enforced
+func (SQLiteDialect) AlterToText(table string, column string) (string) { return "" }
+func (SQLiteDialect) CurrentSchema() (string) { return "" }
+func (SQLiteDialect) TextSearch() (string) { return "fts5" }
+
+func (SQLiteDialect) Concat(exprs ...string) (string) {
+	return strings.Join(exprs,"||")
+}
+
+func (SQLiteDialect) Limit(offset bool) (string) {
+	if offset { return "LIMIT ? OFFSET ?" }
+	return "LIMIT ?"
+}
+
+func (SQLiteDialect) Upsert(table string, key string, columns []string, policy string) (string) {
+	return onConflict(table,key,columns,policy)
+}
+
+func (SQLiteDialect) Retryable(err error) (bool) {
+	var liteErr sqlite3.Error
+	if !errors.As(err,&liteErr) { return false }
+	return liteErr.Code == sqlite3.ErrBusy || liteErr.Code == sqlite3.ErrLocked
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//
+// Keyword search over cached titles and authors. Text is folded before it is
+// indexed or searched (lower case, diacritics removed, punctuation dropped),
+// so "Brontë" matches "bronte" whichever database is in use; each database
+// then indexes the folded text in its own way (see SQLShim).
+//
+
+// Most terms used from a query; the rest are ignored
+const maxSearchTerms = 10
+
+// Latin letters with diacritics, and the letters they fold to
+var foldLetters = func() map[rune]string {
+	m := map[rune]string {}
+	for base, variants := range map[string]string {
+		"a": "àáâãäåāăąǎ", "c": "çćĉċč", "d": "ďđð", "e": "èéêëēĕėęě",
+		"g": "ĝğġģ", "h": "ĥħ", "i": "ìíîïĩīĭįı", "j": "ĵ", "k": "ķ",
+		"l": "ĺļľŀł", "n": "ñńņňŉ", "o": "òóôõöøōŏőǒ", "r": "ŕŗř",
+		"s": "śŝşšș", "t": "ţťŧț", "u": "ùúûüũūŭůűųǔ", "w": "ŵ",
+		"y": "ýÿŷ", "z": "źżž",
+		"ss": "ß", "ae": "æ", "oe": "œ", "th": "þ", "ij": "ĳ",
+	} {
+		for _, r := range variants { m[r] = base }
+	}
+	return m
+}()
+
+// Returns text in the folded form used for searching: lower case words of
+// letters and digits, without diacritics, separated by single spaces.
+func foldText(s string) (string) {
+	builder := strings.Builder {}
+	space := true
+
+	for _, r := range strings.ToLower(s) {
+		switch {
+			case foldLetters[r] != "":
+				builder.WriteString(foldLetters[r])
+				space = false
+			case unicode.Is(unicode.Mn,r):
+				// Combining marks, as in decomposed text, are dropped
+			case unicode.IsLetter(r) || unicode.IsDigit(r):
+				builder.WriteRune(r)
+				space = false
+			case !space:
+				builder.WriteRune(' ')
+				space = true
+		}
+	}
+
+	return strings.TrimSpace(builder.String())
+}
+
+// Returns the folded text indexed for an item
+func searchText(item *BarcodeItem) (string) {
+	return foldText(item.Title+" "+item.Author)
+}
+
+// Returns the folded terms of a search query
+func searchTerms(query string) ([]string) {
+	terms := strings.Fields(foldText(query))
+	if len(terms) > maxSearchTerms { terms = terms[:maxSearchTerms] }
+	return terms
+}
+
+//
+// Returns cached items matching every keyword in ?q=, best matches first.
+// Results are paged via ?limit= (default 20, at most 100) and ?offset=.
+//
+
+func searchHandler(w http.ResponseWriter, r *http.Request, localServer BarcodeServerInterface, remoteServer BarcodeServerInterface) {
+	query := r.URL.Query().Get("q")
+	log.Println(fmt.Sprintf("Incoming on %s : search \"%s\" (from %s)",r.URL.Path,query,r.RemoteAddr))
+
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		http.Error(w, "No search terms", http.StatusBadRequest)
+		return
+	}
+
+	index, ok := localServer.(SearchInterface)
+	if !ok {
+		http.Error(w, "Search not supported by local server", http.StatusNotImplemented)
+		return
+	}
+	if cacheUnavailable(w,localServer) { return }
+
+	limit, offset := 20, 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			http.Error(w, "Invalid limit (1-100)", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	// One extra result tells us whether there is a further page
+	items := index.Search(terms,limit+1,offset)
+
+	result := struct {
+		Query string `json:"query"`
+		Offset int `json:"offset"`
+		Results []*BarcodeItem `json:"results"`
+		Next *int `json:"next_offset,omitempty"`
+	} {
+		Query: strings.Join(terms," "),
+		Offset: offset,
+		Results: items,
+	}
+
+	if len(items) > limit {
+		result.Results = items[:limit]
+		next := offset+limit
+		result.Next = &next
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(&result)
+	if err != nil { log.Println("Unable to write search result: ",err) }
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+//
+// Barcode validation. Incoming barcodes are normalized (whitespace removed,
+// upper case), then checked against the symbologies common in libraries:
+//
+// - EAN-13 (13 digits), incl. ISBN-13 in the 978/979 range
+// - UPC-A (12 digits)
+// - ISBN-10 (9 digits + check digit or X)
+// - Codabar library barcodes (14 digits, mod 10 check digit)
+// - Code 39 (A-Z, 0-9 and -.$/+%), for anything else
+//
+// Numeric barcodes of the EAN/UPC/Codabar lengths, and hyphenated ISBNs,
+// must have a valid check digit; anything that fits no symbology is rejected.
+//
+
+const (
+	symbologyISBN13 = "isbn13"
+	symbologyEAN13 = "ean13"
+	symbologyUPCA = "upca"
+	symbologyISBN10 = "isbn10"
+	symbologyCodabar = "codabar"
+	symbologyCode39 = "code39"
+)
+
+// Longest barcode the database will hold
+const maxBarcodeLength = 50
+
+// Returns true if every character of s is a decimal digit
+func allDigits(s string) (bool) {
+	for _, r := range s {
+		if r < '0' || r > '9' { return false }
+	}
+	return len(s) > 0
+}
+
+// Returns true if s is a 14-digit library Codabar barcode with a valid check
+// digit: digits in odd positions are doubled (less 9 if over 9), and the
+// check digit brings the sum to a multiple of 10.
+func validCodabar14(s string) (bool) {
+	if len(s) != 14 || !allDigits(s) { return false }
+
+	sum := 0
+	for i, r := range s[:13] {
+		d := int(r-'0')
+		if i%2 == 0 {
+			d *= 2
+			if d > 9 { d -= 9 }
+		}
+		sum += d
+	}
+
+	return int(s[13]-'0') == (10-sum%10)%10
+}
+
+// Returns true if s uses only the Code 39 character set (sans space)
+func validCode39(s string) (bool) {
+	for _, r := range s {
+		if !((r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune("-.$/+%",r)) {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+// Returns the symbology of a numeric barcode, "" if it has no numeric
+// symbology, or an error if it has the length of one but a bad check digit.
+func numericSymbology(s string) (string, error) {
+	switch len(s) {
+		case 10:
+			if validISBN10(s) { return symbologyISBN10, nil }
+		case 12:
+			if validEAN13("0"+s) { return symbologyUPCA, nil }
+			return "", fmt.Errorf("invalid UPC-A check digit")
+		case 13:
+			if validISBN13(s) { return symbologyISBN13, nil }
+			if validEAN13(s) { return symbologyEAN13, nil }
+			return "", fmt.Errorf("invalid EAN-13 check digit")
+		case 14:
+			if validCodabar14(s) { return symbologyCodabar, nil }
+			return "", fmt.Errorf("invalid Codabar check digit")
+	}
+	return "", nil
+}
+
+// Returns the normalized form of a barcode and its symbology, or an error
+// describing why it was rejected.
+func normalizeBarcode(barcode string) (string, string, error) {
+	barcode = strings.ToUpper(strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) { return -1 }
+		return r
+	}, barcode))
+
+	if barcode == "" { return "", "", fmt.Errorf("empty barcode") }
+	if len(barcode) > maxBarcodeLength {
+		return "", "", fmt.Errorf("barcode longer than %d characters", maxBarcodeLength)
+	}
+
+	// Hyphenated ISBN/EAN forms are reduced to their digits, and need a valid
+	// check digit as much as unhyphenated ones, rather than pass as Code 39
+	digits := strings.ReplaceAll(barcode,"-","")
+	if isbn, ok := isbnFromBarcode(digits); ok && len(isbn) == 10 && strings.HasSuffix(isbn,"X") {
+		return isbn, symbologyISBN10, nil
+	}
+
+	if allDigits(digits) {
+		symbology, err := numericSymbology(digits)
+		if err != nil { return "", "", err }
+		if symbology != "" { return digits, symbology, nil }
+	}
+
+	if digits != barcode && len(digits) == 10 && allDigits(digits[:9]) && (digits[9] == 'X' || allDigits(digits[9:])) {
+		return "", "", fmt.Errorf("invalid ISBN-10 check digit")
+	}
+
+	if validCode39(barcode) { return barcode, symbologyCode39, nil }
+
+	return "", "", fmt.Errorf("barcode contains characters outside Code 39")
+}
+
+// Returns the symbology of an already-normalized barcode; "" if unknown
+func barcodeSymbology(barcode string) (string) {
+	_, symbology, err := normalizeBarcode(barcode)
+	if err != nil { return "" }
+	return symbology
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+//
+// Barcode normalization, and the check digits of each symbology
+//
+
+func TestNormalizeBarcode(t *testing.T) {
+	tests := []struct {
+		barcode string
+		normalized, symbology string // Empty if rejected
+	} {
+		{"9780261103344", "9780261103344", symbologyISBN13},
+		{"978-0-261-10334-4", "9780261103344", symbologyISBN13},
+		{"978-0-261-10334-3", "", ""},
+		{"9780261103343", "", ""},
+		{"4006381333931", "4006381333931", symbologyEAN13},
+		{"036000291452", "036000291452", symbologyUPCA},
+		{"036000291453", "", ""},
+		{"0-261-10334-2", "0261103342", symbologyISBN10},
+		{"0-261-10334-3", "", ""},
+		{"0-8044-2957-x", "080442957X", symbologyISBN10},
+		{"0-8044-2957-9", "", ""},
+		{"0261103342", "0261103342", symbologyISBN10},
+		{"0261103343", "0261103343", symbologyCode39}, // Unhyphenated, so may be any number
+		{"31234000123453", "31234000123453", symbologyCodabar},
+		{"31234000123450", "", ""},
+		{" ab-12 ", "AB-12", symbologyCode39},
+		{"666", "666", symbologyCode39},
+		{"AB_12", "", ""},
+		{"", "", ""},
+	}
+
+	for _, test := range tests {
+		normalized, symbology, err := normalizeBarcode(test.barcode)
+		if test.symbology == "" {
+			if err == nil { t.Errorf("normalizeBarcode(%q) = %q, %q, want rejected", test.barcode, normalized, symbology) }
+			continue
+		}
+		if err != nil || normalized != test.normalized || symbology != test.symbology {
+			t.Errorf("normalizeBarcode(%q) = %q, %q, %v, want %q, %q", test.barcode, normalized, symbology, err, test.normalized, test.symbology)
+		}
+	}
+}
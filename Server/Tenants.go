@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+//
+// Tenant namespaces, so one server process can host the caches of several
+// libraries without their data mixing. Each tenant has its own table in the
+// database, and its own upstream configuration. A request selects a tenant
+// by path prefix (/api/v1/t/{tenant}/...), by the X-Tenant header, or by a
+// bearer token; requests selecting no tenant use the default tenant, which
+// is configured from the command line.
+//
+
+// Tenant description, as read from the tenants file
+type TenantConfig struct {
+	Name string `json:"name"`
+	Token string `json:"token"` // If set, required on every request
+	Upstream string `json:"upstream"` // e.g. "alma"; see newUpstream()
+	URL string `json:"url"`
+	Key string `json:"key"`
+	Quota int `json:"quota"` // Daily lookups outside any route (0 = unlimited)
+	Routes string `json:"routes"` // Optional routes file
+}
+
+type Tenant struct {
+	name string
+	token string
+	quota int // Daily upstream lookups outside any route (0 = unlimited)
+	local BarcodeServerInterface
+	remote *TenantServer
+}
+
+type Tenants struct {
+	byName map[string]*Tenant
+	byToken map[string]*Tenant
+	fallback *Tenant // for requests that do not name a tenant
+}
+
+// Tenant names become part of table names, so are restricted
+var tenantName = regexp.MustCompile("^[a-z0-9_]{1,30}$")
+
+// Creates the tenant list, with the default tenant using the specified
+// servers and daily quota
+func newTenants(localServer BarcodeServerInterface, remoteServer BarcodeServerInterface, quota int) (*Tenants) {
+	fallback := &Tenant {
+		name: "default",
+		quota: quota,
+		local: localServer,
+		remote: &TenantServer { name: "default", server: remoteServer },
+	}
+
+	return &Tenants {
+		byName: map[string]*Tenant {},
+		byToken: map[string]*Tenant {},
+		fallback: fallback,
+	}
+}
+
+// Reads tenants from a JSON file containing a list of TenantConfig, starting
+// a local server (via newLocal, given the table name) and upstream for each.
+func (t *Tenants) Load(filePath string, newLocal func(table string) BarcodeServerInterface) (error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil { return err }
+
+	configs := []TenantConfig {}
+	if err := json.Unmarshal(data,&configs); err != nil { return err }
+
+	for _, config := range configs {
+		if !tenantName.MatchString(config.Name) {
+			return fmt.Errorf("invalid tenant name '%s' (use a-z, 0-9, _)", config.Name)
+		}
+		if _, ok := t.byName[config.Name]; ok {
+			return fmt.Errorf("duplicate tenant '%s'", config.Name)
+		}
+		if _, ok := t.byToken[config.Token]; ok && (config.Token != "") {
+			return fmt.Errorf("tenant '%s' reuses another tenant's token", config.Name)
+		}
+
+		kind := config.Upstream
+		if kind == "" {
+			kind = "random"
+			if config.Key != "" { kind = "alma" }
+		}
+
+		upstream, err := newUpstream(kind, config.URL, config.Key)
+		if err != nil { return fmt.Errorf("tenant '%s': %v", config.Name, err) }
+
+		quota := &Quota { limit: config.Quota, key: "tenant/"+config.Name }
+		var remote BarcodeServerInterface = &QuotaServer { server: upstream, quota: quota }
+
+		if config.Routes != "" {
+			routes, err := loadRoutes(config.Routes)
+			if err != nil { return fmt.Errorf("tenant '%s': %v", config.Name, err) }
+
+			remote, err = newRouterServer(routes, remote, quota)
+			if err != nil { return fmt.Errorf("tenant '%s': %v", config.Name, err) }
+		}
+
+		tenant := &Tenant {
+			name: config.Name,
+			token: config.Token,
+			quota: config.Quota,
+			local: newLocal("barcodes_"+config.Name),
+			remote: &TenantServer { name: config.Name, server: remote },
+		}
+
+		t.byName[tenant.name] = tenant
+		if tenant.token != "" { t.byToken[tenant.token] = tenant }
+
+		log.Println("Tenant '"+tenant.name+"' -> "+kind)
+	}
+
+	return nil
+}
+
+// Shuts down the servers of every tenant, including the default
+func (t *Tenants) Shutdown() {
+	for _, tenant := range t.all() {
+		tenant.local.Shutdown()
+		tenant.remote.Shutdown()
+	}
+}
+
+// Returns the configured (non-default) tenants
+func (t *Tenants) list() ([]*Tenant) {
+	tenants := []*Tenant {}
+	for _, tenant := range t.byName { tenants = append(tenants,tenant) }
+	return tenants
+}
+
+// Returns every tenant, including the default
+func (t *Tenants) all() ([]*Tenant) {
+	return append(t.list(), t.fallback)
+}
+
+// Returns the tenant with the given name; empty = default tenant
+func (t *Tenants) Get(name string) (*Tenant) {
+	if name == "" { return t.fallback }
+	return t.byName[name]
+}
+
+// Returns the tenant selected by a request, or nil and a HTTP status code
+func (t *Tenants) resolve(r *http.Request) (*Tenant, int) {
+	name := mux.Vars(r)["tenant"]
+	if name == "" { name = r.Header.Get("X-Tenant") }
+
+	token := ""
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth,"Bearer ") {
+		token = strings.TrimPrefix(auth,"Bearer ")
+	}
+
+	var tenant *Tenant
+
+	switch {
+		case name != "":
+			tenant = t.byName[name]
+			if tenant == nil { return nil, http.StatusNotFound }
+		case token != "" && t.byToken[token] != nil:
+			tenant = t.byToken[token]
+		default:
+			tenant = t.fallback
+	}
+
+	if (tenant.token != "") && (token != tenant.token) { return nil, http.StatusUnauthorized }
+
+	return tenant, http.StatusOK
+}
+
+// Handler signature shared by the API endpoints
+type handlerFunc func(w http.ResponseWriter, r *http.Request, localServer BarcodeServerInterface, remoteServer BarcodeServerInterface)
+
+// Wraps an API handler so it is called with the servers of the selected tenant
+func (t *Tenants) Handle(fn handlerFunc) (http.HandlerFunc) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant, status := t.resolve(r)
+		if tenant == nil {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+
+		tenant.remote.countRequest()
+		fn(w,r,tenant.local,tenant.remote)
+	}
+}
+
+//
+// BarcodeServerInterface wrapper around a tenant's upstream server, which
+// keeps per-tenant statistics.
+//
+
+type TenantServer struct {
+	name string
+	server BarcodeServerInterface
+
+	requests, lookups, found int
+	mutex sync.Mutex
+}
+
+// params = passed on to the wrapped server
+func (s *TenantServer) Startup(params string) {
+	s.server.Startup(params)
+}
+
+// Shuts down the wrapped server
+func (s *TenantServer) Shutdown() {
+	s.server.Shutdown()
+}
+
+// Returns a BarcodeItem from the wrapped server
+func (s *TenantServer) Lookup(barcode string) (*BarcodeItem) { return s.LookupVia(barcode,nil) }
+
+// As Lookup, for a request forwarded by the given servers
+func (s *TenantServer) LookupVia(barcode string, via []string) (*BarcodeItem) {
+	result := lookupVia(s.server,barcode,via)
+
+	s.mutex.Lock()
+	s.lookups++
+	if result != nil { s.found++ }
+	s.mutex.Unlock()
+
+	return result
+}
+
+// Returns the copy count from the wrapped server
+func (s *TenantServer) CountCopies(barcode string, raw []byte) (int, bool) {
+	x, ok := s.server.(CopyCounterInterface)
+	if !ok { return 0, false }
+	return x.CountCopies(barcode,raw)
+}
+
+// Returns true if the wrapped server's quota allows a further lookup
+func (s *TenantServer) QuotaLeft(barcode string) (bool) {
+	x, ok := s.server.(QuotaCheckInterface)
+	return !ok || x.QuotaLeft(barcode)
+}
+
+// Returns true if the wrapped server looks barcodes up in Alma
+func (s *TenantServer) HasAlma() (bool) {
+	x, ok := s.server.(AlmaLookupInterface)
+	return ok && x.HasAlma()
+}
+
+// Returns a BarcodeItem from Alma via the wrapped server
+func (s *TenantServer) LookupAlma(barcode string) (*BarcodeItem, error) {
+	x, ok := s.server.(AlmaLookupInterface)
+	if !ok { return nil, errNoAlma }
+	return x.LookupAlma(barcode)
+}
+
+// Dummy function (included to satisfy BarcodeServerInterface)
+func (s *TenantServer) Store(info *BarcodeItem) {
+	log.Println("Store called on read-only tenant server!")
+}
+
+// Counts an API request made by the tenant
+func (s *TenantServer) countRequest() {
+	s.mutex.Lock()
+	s.requests++
+	s.mutex.Unlock()
+}
+
+// Returns the tenant's request counts, plus those of the wrapped server
+func (s *TenantServer) Stats() (map[string]interface{}) {
+	stats := map[string]interface{} {}
+	if x, ok := s.server.(StatsInterface); ok { stats = x.Stats() }
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats["tenant"] = map[string]interface{} {
+		"name": s.name,
+		"requests": s.requests,
+		"upstream_lookups": s.lookups,
+		"upstream_found": s.found,
+	}
+
+	return stats
+}
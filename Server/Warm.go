@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//
+// Cache warming, e.g. before an inventory, from a list of barcodes such as
+// an Alma Analytics export. Barcodes already cached are skipped; the rest
+// are fetched from upstream by several workers, at a limited rate. Barcodes
+// whose upstream quota is exhausted are deferred, so a later run (e.g. the
+// next day) picks them up; the quota is shared with a server running at the
+// same time through the quota file. The warm command records finished barcodes in a
+// progress file, so an interrupted run can resume where it left off.
+//
+
+// Progress of a warm-up run
+type WarmStatus struct {
+	Total int `json:"total"`
+	Processed int `json:"processed"`
+	Cached int `json:"already_cached"`
+	Fetched int `json:"fetched"`
+	NotFound int `json:"not_found"`
+	Deferred int `json:"deferred"` // Upstream quota exhausted
+	Invalid int `json:"invalid"`
+	Resumed int `json:"resumed"` // Done by an earlier run
+
+	Started time.Time `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Stopped bool `json:"stopped,omitempty"` // Interrupted before the end
+
+	mutex sync.Mutex
+}
+
+// Returns a copy of the status, safe to read
+func (s *WarmStatus) snapshot() (WarmStatus) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return WarmStatus {
+		Total: s.Total, Processed: s.Processed,
+		Cached: s.Cached, Fetched: s.Fetched, NotFound: s.NotFound,
+		Deferred: s.Deferred, Invalid: s.Invalid, Resumed: s.Resumed,
+		Started: s.Started, Finished: s.Finished, Stopped: s.Stopped,
+	}
+}
+
+func (s *WarmStatus) String() (string) {
+	x := s.snapshot()
+	return fmt.Sprintf("%d/%d processed: %d fetched, %d not found, %d already cached, %d deferred, %d invalid, %d done earlier",
+		x.Processed, x.Total, x.Fetched, x.NotFound, x.Cached, x.Deferred, x.Invalid, x.Resumed)
+}
+
+// Highest rate of upstream lookups a run may be given
+const maxWarmRate = 1000
+
+// Returns an error unless rate is from 0 (unlimited) to maxWarmRate
+func checkWarmRate(rate float64) (error) {
+	if !(rate >= 0 && rate <= maxWarmRate) { return fmt.Errorf("rate must be from 0 to %d lookups a second", maxWarmRate) }
+	return nil
+}
+
+type WarmOptions struct {
+	Concurrency int // Workers fetching from upstream
+	Rate float64 // Upstream lookups per second (0 = unlimited)
+	Done map[string]bool // Barcodes finished by an earlier run
+	Record io.Writer // Finished barcodes are written here, one per line (optional)
+}
+
+// Reads a barcode list: the first field of each line, separated by commas,
+// tabs or semicolons. Blank lines are ignored, as is a header line whose
+// first field mentions "barcode".
+func readBarcodeList(r io.Reader) ([]string, error) {
+	barcodes := []string {}
+	header := true
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		field := strings.FieldsFunc(scanner.Text(), func(r rune) bool {
+			return r == ',' || r == '\t' || r == ';'
+		})
+		if len(field) == 0 { continue }
+
+		barcode := strings.Trim(strings.TrimSpace(field[0]),`"`)
+		if header && strings.Contains(strings.ToLower(barcode),"barcode") { continue }
+		header = false
+
+		if barcode != "" { barcodes = append(barcodes,barcode) }
+	}
+
+	return barcodes, scanner.Err()
+}
+
+// Warms the local cache from the barcode list, until done or ctx is cancelled
+func warmCache(ctx context.Context, barcodes []string, localServer BarcodeServerInterface, remoteServer BarcodeServerInterface, opts WarmOptions, status *WarmStatus) {
+	status.mutex.Lock()
+	status.Total, status.Started = len(barcodes), time.Now()
+	status.mutex.Unlock()
+
+	if opts.Concurrency < 1 { opts.Concurrency = 1 }
+
+	// Upstream lookups wait for a tick, shared by all workers
+	var ticks <-chan time.Time
+	if interval := time.Duration(float64(time.Second)/opts.Rate); opts.Rate > 0 && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	var recordMutex sync.Mutex
+	record := func(barcode string) {
+		if opts.Record == nil { return }
+		recordMutex.Lock()
+		fmt.Fprintln(opts.Record,barcode)
+		recordMutex.Unlock()
+	}
+
+	count := func(counter *int) {
+		status.mutex.Lock()
+		*counter++
+		status.Processed++
+		status.mutex.Unlock()
+	}
+
+	quotaCheck, hasQuota := remoteServer.(QuotaCheckInterface)
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for barcode := range work {
+				normalized, symbology, err := normalizeBarcode(barcode)
+				switch {
+					case err != nil:
+						log.Println("Warm: skipping invalid barcode \""+barcode+"\": ",err)
+						count(&status.Invalid)
+						continue
+					case opts.Done[normalized]:
+						count(&status.Resumed)
+						continue
+					case localServer.Lookup(normalized) != nil:
+						count(&status.Cached)
+						record(normalized)
+						continue
+					case hasQuota && !quotaCheck.QuotaLeft(normalized):
+						count(&status.Deferred)
+						continue
+				}
+
+				if ticks != nil {
+					select {
+						case <-ticks:
+						case <-ctx.Done(): return
+					}
+				}
+
+				// Workers race for the last of the quota, so a miss may be a refusal
+				switch {
+					case fetchItem(normalized,symbology,localServer,remoteServer,nil) != nil:
+						count(&status.Fetched)
+					case hasQuota && !quotaCheck.QuotaLeft(normalized):
+						count(&status.Deferred)
+						continue
+					default:
+						count(&status.NotFound)
+				}
+				record(normalized)
+			}
+		}()
+	}
+
+	// Progress is logged every 10 seconds
+	progress := time.NewTicker(10 * time.Second)
+	defer progress.Stop()
+
+	feed:
+	for _, barcode := range barcodes {
+		for {
+			select {
+				case work <- barcode:
+					continue feed
+				case <-progress.C:
+					log.Println("Warm: "+status.String())
+				case <-ctx.Done():
+					break feed
+			}
+		}
+	}
+
+	close(work)
+	wg.Wait()
+
+	now := time.Now()
+	status.mutex.Lock()
+	status.Finished, status.Stopped = &now, ctx.Err() != nil
+	status.mutex.Unlock()
+
+	log.Println("Warm: "+status.String())
+}
+
+//
+// Command
+//
+
+func init() {
+	commands["warm"] = warmCommand
+}
+
+// Warms the cache from a barcode list file; interrupting it (Ctrl+C) stops
+// it cleanly, and running it again resumes from the progress file.
+func warmCommand(args []string, localServer BarcodeServerInterface, remoteServer BarcodeServerInterface) error {
+	flags := flag.NewFlagSet("warm", flag.ContinueOnError)
+	concurrency := flags.Int("concurrency", 4, "Upstream lookups made in parallel.")
+	rate := flags.Float64("rate", 5, "Upstream lookups per second (0 = unlimited).")
+	progressFile := flags.String("progress", "", "File recording finished barcodes (empty = list file + \".progress\").")
+	restart := flags.Bool("restart", false, "Ignore any earlier progress.")
+	if err := flags.Parse(args); err != nil { return err }
+
+	if flags.NArg() != 1 { return fmt.Errorf("usage: warm [flags] barcode-list-file") }
+	if err := checkWarmRate(*rate); err != nil { return err }
+	fileName := flags.Arg(0)
+
+	in, err := os.Open(fileName)
+	if err != nil { return err }
+	barcodes, err := readBarcodeList(in)
+	in.Close()
+	if err != nil { return err }
+
+	if *progressFile == "" { *progressFile = fileName+".progress" }
+	if *restart { os.Remove(*progressFile) }
+
+	done := map[string]bool {}
+	if data, err := os.ReadFile(*progressFile); err == nil {
+		for _, barcode := range strings.Fields(string(data)) { done[barcode] = true }
+		log.Println(fmt.Sprintf("Warm: resuming, with %d barcodes already done", len(done)))
+	}
+
+	out, err := os.OpenFile(*progressFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil { return err }
+	defer out.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+			case <-sig:
+				log.Println("Warm: interrupted; stopping ...")
+				cancel()
+			case <-ctx.Done():
+		}
+	}()
+
+	opts := WarmOptions { Concurrency: *concurrency, Rate: *rate, Done: done, Record: out }
+	warmCache(ctx,barcodes,localServer,remoteServer,opts,&WarmStatus {})
+
+	return nil
+}
+
+//
+// Admin endpoint: POST a barcode list to start warming in the background
+// (?concurrency=, ?rate=); GET reports progress. One run per tenant at a time.
+//
+
+var warmJobs = struct {
+	byServer map[BarcodeServerInterface]*warmJob
+	mutex sync.Mutex
+} { byServer: map[BarcodeServerInterface]*warmJob {} }
+
+type warmJob struct {
+	status *WarmStatus
+	cancel context.CancelFunc
+	done chan struct{}
+}
+
+// Stops any running warm-up jobs and waits for them, e.g. before shutdown
+func stopWarmJobs() {
+	warmJobs.mutex.Lock()
+	defer warmJobs.mutex.Unlock()
+
+	for _, job := range warmJobs.byServer {
+		job.cancel()
+		<-job.done
+	}
+}
+
+func warmHandler(w http.ResponseWriter, r *http.Request, localServer BarcodeServerInterface, remoteServer BarcodeServerInterface) {
+	log.Println(fmt.Sprintf("Incoming on %s : warm \"%s\" (from %s)",r.URL.Path,r.URL.RawQuery,r.RemoteAddr))
+
+	warmJobs.mutex.Lock()
+	job := warmJobs.byServer[localServer]
+	warmJobs.mutex.Unlock()
+
+	reply := func(status int, job *warmJob) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+
+		var snapshot interface{}
+		if job != nil { x := job.status.snapshot(); snapshot = &x }
+		if err := json.NewEncoder(w).Encode(snapshot); err != nil { log.Println("Unable to write warm status: ",err) }
+	}
+
+	switch r.Method {
+		case http.MethodGet:
+			if job == nil {
+				http.Error(w, "No warm-up run", http.StatusNotFound)
+				return
+			}
+			reply(http.StatusOK,job)
+			return
+
+		case http.MethodPost:
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+	}
+
+	opts := WarmOptions { Concurrency: 4, Rate: 5 }
+	if v := r.URL.Query().Get("concurrency"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 64 {
+			http.Error(w, "Invalid concurrency (1-64)", http.StatusBadRequest)
+			return
+		}
+		opts.Concurrency = n
+	}
+	if v := r.URL.Query().Get("rate"); v != "" {
+		n, err := strconv.ParseFloat(v,64)
+		if err == nil { err = checkWarmRate(n) }
+		if err != nil {
+			http.Error(w, "Invalid rate: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.Rate = n
+	}
+
+	barcodes, err := readBarcodeList(r.Body)
+	if err != nil {
+		http.Error(w, "Unable to read barcode list: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	warmJobs.mutex.Lock()
+	if job := warmJobs.byServer[localServer]; job != nil && job.status.snapshot().Finished == nil {
+		warmJobs.mutex.Unlock()
+		http.Error(w, "A warm-up run is already in progress", http.StatusConflict)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job = &warmJob {
+		status: &WarmStatus { Total: len(barcodes), Started: time.Now() },
+		cancel: cancel,
+		done: make(chan struct{}),
+	}
+	warmJobs.byServer[localServer] = job
+	warmJobs.mutex.Unlock()
+
+	go func() {
+		defer close(job.done)
+		warmCache(ctx,barcodes,localServer,remoteServer,opts,job.status)
+	}()
+
+	reply(http.StatusAccepted,job)
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//
+// Write-behind queue for items stored in a local server, so requests are
+// answered without waiting for the database. Stores are queued, up to a
+// limit, and written by a background goroutine; lookups of items still
+// queued are answered from the queue. If the queue is full, items are
+// spilled to a JSON Lines file in the export format, and written once the
+// queue has drained (or by the next run, if the server stops first); the
+// spill is indexed, so lookups find spilled items, and a spilled copy is
+// not written if a later one was queued.
+// Shutdown writes everything still queued. Other calls go straight to the
+// wrapped server, so accesses to items still queued are not counted.
+//
+
+type WriteBehindServer struct {
+	*ResilientServer
+	size int // Items queued at most
+	spillPath string
+
+	mutex sync.Mutex // guards the fields below
+	queue chan string // Barcodes of queued items, in order
+	pending map[string]*writeBehindItem // Queued items, by barcode
+	current *writeBehindItem // Item being written, if any
+	closed bool
+	spillWaiting bool // Items have been spilled since the spill was last written
+	spillIndex map[string]spillRef // Latest spilled copy of each item not yet written
+	done chan struct{}
+
+	// Metrics
+	maxDepth int
+	written int
+	spilled int
+	writeTime time.Duration // Total time spent writing items
+	maxWrite time.Duration
+	waitTime time.Duration // Total time items were queued, until written
+	maxWait time.Duration
+}
+
+// Queued item, with the time it was first queued
+type writeBehindItem struct {
+	item *BarcodeItem
+	queued time.Time
+	deleted bool // Deleted while being written, so deleted again after
+}
+
+// Line of a spilled item
+type spillRef struct {
+	path string
+	offset int64
+}
+
+// Spill being written, kept apart from further items spilled meanwhile
+func (s *WriteBehindServer) spillWritingPath() (string) {
+	return s.spillPath+".writing"
+}
+
+// Starts the wrapped server, then the background writer; items spilled by
+// an earlier run are written first
+func (s *WriteBehindServer) Startup(params string) {
+	s.ResilientServer.Startup(params)
+
+	s.queue = make(chan string, s.size)
+	s.pending = map[string]*writeBehindItem {}
+	s.spillIndex = map[string]spillRef {}
+	s.done = make(chan struct{})
+
+	// The spill being written is older, so later lines of either win
+	for _, path := range []string {s.spillWritingPath(), s.spillPath} {
+		if _, err := os.Stat(path); err == nil {
+			log.Println("Found write-behind spill "+path+" left by an earlier run")
+			s.spillWaiting = true
+			if err := s.indexSpill(path); err != nil { log.Println("Unable to read spill "+path+": ",err) }
+		}
+	}
+
+	go s.writer()
+}
+
+// Writes the items still queued, then shuts down the wrapped server. Any
+// spilled items not yet written are left for the next run.
+func (s *WriteBehindServer) Shutdown() {
+	s.mutex.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mutex.Unlock()
+
+	<-s.done
+
+	if s.spillWaiting { log.Println("Write-behind spill "+s.spillPath+" left to be written by the next run") }
+	s.ResilientServer.Shutdown()
+}
+
+// Queues an item to be stored, spilling it to disk if the queue is full
+func (s *WriteBehindServer) Store(item *BarcodeItem) {
+	if !s.enqueue(item) { s.ResilientServer.Store(item) }
+}
+
+// Queues or spills an item, returning false if it must be stored at once
+func (s *WriteBehindServer) enqueue(item *BarcodeItem) (bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed { return false }
+
+	// Copies are written in the order stored, not as the spill happens to
+	// fall, so an undated copy is dated now
+	if item.Fetched == nil {
+		dated := *item
+		now := time.Now().UTC()
+		dated.Fetched = &now
+		item = &dated
+	}
+
+	// An item still queued is simply replaced
+	if queued, ok := s.pending[item.Barcode]; ok {
+		queued.item = item
+		return true
+	}
+
+	select {
+		case s.queue <- item.Barcode:
+			s.pending[item.Barcode] = &writeBehindItem { item: item, queued: time.Now() }
+			delete(s.spillIndex,item.Barcode) // Any spilled copy is older
+			if depth := len(s.queue); depth > s.maxDepth { s.maxDepth = depth }
+			return true
+		default:
+	}
+
+	// Rather than lose the item, the request waits for it to be stored
+	offset, err := appendExportRecord(s.spillPath,item)
+	if err != nil {
+		log.Println("Unable to write spill "+s.spillPath+": ",err)
+		return false
+	}
+	s.spillIndex[item.Barcode] = spillRef { path: s.spillPath, offset: offset }
+	s.spillWaiting = true
+	s.spilled++
+	return true
+}
+
+// Returns a BarcodeItem from the queue, or the wrapped server
+func (s *WriteBehindServer) Lookup(barcode string) (*BarcodeItem) {
+	if item := s.queued(barcode); item != nil { return item }
+	return s.ResilientServer.Lookup(barcode)
+}
+
+func (s *WriteBehindServer) LookupRaw(barcode string) (raw []byte, source string) {
+	if item := s.queued(barcode); item != nil { return item.Raw, item.Source }
+	return s.ResilientServer.LookupRaw(barcode)
+}
+
+// Drops any queued or spilled copy of the item, as well as deleting it; a
+// copy being written is deleted once written
+func (s *WriteBehindServer) Delete(barcode string) {
+	s.mutex.Lock()
+	delete(s.pending,barcode)
+	delete(s.spillIndex,barcode)
+	if s.current != nil && s.current.item.Barcode == barcode { s.current.deleted = true }
+	s.mutex.Unlock()
+
+	s.ResilientServer.Delete(barcode)
+}
+
+// Returns the latest queued or spilled copy of an item, if any
+func (s *WriteBehindServer) queued(barcode string) (*BarcodeItem) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if queued, ok := s.pending[barcode]; ok { return queued.item }
+	if s.current != nil && s.current.item.Barcode == barcode {
+		if s.current.deleted { return nil }
+		return s.current.item
+	}
+
+	// Read under the lock, so the spill is not renamed meanwhile
+	if ref, ok := s.spillIndex[barcode]; ok {
+		item, err := readSpilled(ref)
+		if err != nil { log.Println("Unable to read spill "+ref.path+": ",err) }
+		return item
+	}
+	return nil
+}
+
+// Writes queued items until the queue is closed, and spilled items whenever
+// the queue is empty
+func (s *WriteBehindServer) writer() {
+	defer close(s.done)
+
+	for {
+		s.mutex.Lock()
+		writeSpill := s.spillWaiting && len(s.queue) == 0 && !s.closed
+		s.mutex.Unlock()
+
+		// On failure the spill waits for more items to be spilled, or the next run
+		if writeSpill {
+			if err := s.writeSpill(); err != nil {
+				log.Println("Unable to write spill "+s.spillPath+": ",err)
+				s.mutex.Lock()
+				s.spillWaiting = false
+				s.mutex.Unlock()
+			}
+			continue
+		}
+
+		barcode, ok := <-s.queue
+		if !ok { return }
+
+		s.mutex.Lock()
+		queued := s.pending[barcode]
+		delete(s.pending,barcode)
+		s.current = queued
+		s.mutex.Unlock()
+
+		// Deleted while queued
+		if queued == nil { continue }
+
+		s.write(queued)
+	}
+}
+
+// Stores an item in the wrapped server, recording how long it took
+func (s *WriteBehindServer) write(queued *writeBehindItem) {
+	start := time.Now()
+	s.ResilientServer.Store(queued.item)
+	end := time.Now()
+
+	// A Delete() made after this has its own delete follow the store
+	s.mutex.Lock()
+	deleted := queued.deleted
+	s.mutex.Unlock()
+
+	if deleted { s.ResilientServer.Delete(queued.item.Barcode) }
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.current == queued { s.current = nil }
+
+	took, wait := end.Sub(start), end.Sub(queued.queued)
+	s.written++
+	s.writeTime += took
+	s.waitTime += wait
+	if took > s.maxWrite { s.maxWrite = took }
+	if wait > s.maxWait { s.maxWait = wait }
+}
+
+//
+// Spill of items overflowing the queue
+//
+
+// Indexes the items in a spill, each at its latest line
+func (s *WriteBehindServer) indexSpill(path string) (error) {
+	return scanSpill(path, func(item *BarcodeItem, offset int64) (bool) {
+		s.spillIndex[item.Barcode] = spillRef { path: path, offset: offset }
+		return true
+	})
+}
+
+// Calls fn with each item in a spill, and the offset of its line, until fn
+// returns false
+func scanSpill(path string, fn func(item *BarcodeItem, offset int64) (bool)) (error) {
+	file, err := os.Open(path)
+	if err != nil { return err }
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte,64*1024),16*1024*1024)
+
+	offset := int64(0)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		lineOffset := offset
+		offset += int64(len(line))+1
+
+		record := exportRecord {}
+		if err := json.Unmarshal(line,&record); err != nil || record.BarcodeItem == nil { continue }
+
+		item := *record.BarcodeItem
+		item.Raw = record.Raw
+		if !fn(&item,lineOffset) { return nil }
+	}
+	return scanner.Err()
+}
+
+// Reads the spilled item at a line
+func readSpilled(ref spillRef) (*BarcodeItem, error) {
+	file, err := os.Open(ref.path)
+	if err != nil { return nil, err }
+	defer file.Close()
+
+	if _, err := file.Seek(ref.offset,io.SeekStart); err != nil { return nil, err }
+
+	record := exportRecord {}
+	if err := json.NewDecoder(file).Decode(&record); err != nil { return nil, err }
+	if record.BarcodeItem == nil { return nil, fmt.Errorf("no item at offset %d",ref.offset) }
+
+	item := *record.BarcodeItem
+	item.Raw = record.Raw
+	return &item, nil
+}
+
+// Stores the spilled items, in the order spilled, stopping early at
+// shutdown. Items spilled meanwhile go to a new spill, written later. Only
+// the latest copy of an item is written, and none if it has been queued or
+// deleted since.
+func (s *WriteBehindServer) writeSpill() (error) {
+	writing := s.spillWritingPath()
+
+	// A spill left part-written by an earlier run is finished first, leaving
+	// the current one waiting
+	s.mutex.Lock()
+	_, err := os.Stat(writing)
+	if os.IsNotExist(err) {
+		err = os.Rename(s.spillPath,writing)
+		if err == nil {
+			for barcode, ref := range s.spillIndex {
+				if ref.path == s.spillPath { s.spillIndex[barcode] = spillRef { path: writing, offset: ref.offset } }
+			}
+		}
+		if os.IsNotExist(err) { err = nil }
+		s.spillWaiting = false
+	}
+	s.mutex.Unlock()
+	if err != nil { return err }
+
+	closed := false
+	err = scanSpill(writing, func(item *BarcodeItem, offset int64) (bool) {
+		ref := spillRef { path: writing, offset: offset }
+
+		spilled := &writeBehindItem { item: item, queued: time.Now() }
+
+		s.mutex.Lock()
+		closed = s.closed
+		if closed { s.spillWaiting = true }
+		latest := s.spillIndex[item.Barcode] == ref
+		if latest && !closed { s.current = spilled }
+		s.mutex.Unlock()
+
+		if closed { return false }
+		if !latest { return true }
+
+		s.write(spilled)
+
+		s.mutex.Lock()
+		if s.spillIndex[item.Barcode] == ref { delete(s.spillIndex,item.Barcode) }
+		s.mutex.Unlock()
+		return true
+	})
+	if os.IsNotExist(err) { return nil }
+	if err != nil || closed { return err }
+
+	return os.Remove(writing)
+}
+
+// Returns the wrapped server's statistics, and those of the queue
+func (s *WriteBehindServer) Stats() (map[string]interface{}) {
+	stats := s.ResilientServer.Stats()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ms := func(d time.Duration) (float64) { return float64(d) / float64(time.Millisecond) }
+	average := func(total time.Duration) (float64) {
+		if s.written == 0 { return 0 }
+		return ms(total) / float64(s.written)
+	}
+
+	stats["write_behind"] = map[string]interface{} {
+		"size": s.size,
+		"depth": len(s.queue),
+		"max_depth": s.maxDepth,
+		"written": s.written,
+		"spilled": s.spilled,
+		"spill_waiting": s.spillWaiting,
+		"write_ms_avg": average(s.writeTime),
+		"write_ms_max": ms(s.maxWrite),
+		"queued_ms_avg": average(s.waitTime),
+		"queued_ms_max": ms(s.maxWait),
+	}
+	return stats
+}
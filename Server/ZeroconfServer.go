@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"time"
+
 	"github.com/grandcat/zeroconf"
 )
 
@@ -28,3 +32,40 @@ func (s *ZeroconfServer) Shutdown() {
 	if s.server == nil { return }
 	s.server.Shutdown()
 }
+
+// Returns the base URL (http://ip:port) of a named zeroconf service, waiting up to the specified time
+func resolveService(name, service, domain string, wait time.Duration) (string, error) {
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil { return "", err }
+
+	entries := make(chan *zeroconf.ServiceEntry)
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer drainEntries(entries)
+	defer cancel()
+
+	err = resolver.Lookup(ctx, name, service, domain, entries)
+	if err != nil { return "", err }
+
+	select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("zeroconf service '%s' not found", name)
+		case e := <-entries:
+			if len(e.AddrIPv4) > 0 { return fmt.Sprintf("http://%s:%d", e.AddrIPv4[0], e.Port), nil }
+			if len(e.AddrIPv6) > 0 { return fmt.Sprintf("http://[%s]:%d", e.AddrIPv6[0], e.Port), nil }
+			return "", fmt.Errorf("zeroconf service '%s' has no address", name)
+	}
+}
+
+// Discards entries sent after a lookup is given up: the resolver never
+// closes the channel, and would otherwise block on sending the rest of a
+// batch, even once its context is cancelled
+func drainEntries(entries chan *zeroconf.ServiceEntry) {
+	go func() {
+		for {
+			select {
+				case <-entries:
+				case <-time.After(time.Second): return
+			}
+		}
+	}()
+}
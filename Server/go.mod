@@ -3,9 +3,12 @@ module Server
 go 1.16
 
 require (
+	github.com/alicebob/miniredis/v2 v2.23.0
 	github.com/go-sql-driver/mysql v1.6.0
+	github.com/gomodule/redigo v1.8.9
 	github.com/gorilla/mux v1.8.0
 	github.com/grandcat/zeroconf v1.0.0
 	github.com/lib/pq v1.10.0
 	github.com/mattn/go-sqlite3 v1.14.7
+	go.etcd.io/bbolt v1.3.6
 )